@@ -0,0 +1,98 @@
+// (c) 2011-2014 Alexander Solovyov
+// under terms of ISC license
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Backuper saves original content of files before replacement. Backups are
+// put next to originals with a suffix, or in a separate directory mirroring
+// layout of the files relative to current directory (or both).
+type Backuper struct {
+	suffix    string
+	dir       string
+	overwrite bool
+	wd        string
+	absdir    string
+}
+
+func NewBackuper(suffix, dir string, overwrite bool) *Backuper {
+	wd, _ := os.Getwd()
+	absdir := ""
+	if dir != "" {
+		absdir, _ = filepath.Abs(dir)
+	}
+	return &Backuper{suffix, dir, overwrite, wd, absdir}
+}
+
+// IsBackupDir reports if fn is a backup directory, so it won't be searched
+func (b *Backuper) IsBackupDir(fn string) bool {
+	if b == nil || b.absdir == "" {
+		return false
+	}
+	if !filepath.IsAbs(fn) {
+		fn = filepath.Join(b.wd, fn)
+	}
+	return fn == b.absdir
+}
+
+func (b *Backuper) Path(fn string) string {
+	if b.dir == "" {
+		return fn + b.suffix
+	}
+
+	abs := fn
+	if !filepath.IsAbs(abs) {
+		abs = filepath.Join(b.wd, fn)
+	}
+	rel, err := filepath.Rel(b.wd, abs)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		// file is outside of current directory, mirror its absolute path
+		rel = strings.TrimPrefix(abs, filepath.VolumeName(abs))
+	}
+	return filepath.Join(b.dir, rel) + b.suffix
+}
+
+// Backup writes content (which should be the original content of fn) to
+// backup location, refusing to overwrite existing backups unless asked to
+func (b *Backuper) Backup(fn string, content []byte) error {
+	fi, err := os.Stat(fn)
+	if err != nil {
+		return err
+	}
+
+	path := b.Path(fn)
+	if b.dir != "" {
+		if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+			return err
+		}
+	}
+
+	flag := os.O_WRONLY | os.O_CREATE | os.O_EXCL
+	if b.overwrite {
+		flag = os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	}
+
+	f, err := os.OpenFile(path, flag, fi.Mode().Perm())
+	if os.IsExist(err) {
+		return fmt.Errorf("backup '%s' already exists, supply --backup-overwrite to overwrite it",
+			path)
+	}
+	if err != nil {
+		return err
+	}
+
+	_, err = f.Write(content)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
@@ -0,0 +1,303 @@
+// (c) 2011-2014 Alexander Solovyov
+// under terms of ISC license
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+
+	flags "github.com/jessevdk/go-flags"
+)
+
+const (
+	projectConfigName = ".grrc"
+	configEnv         = "GR_OPTS"
+	cmdlineSource     = "command line"
+)
+
+// options read from a config file or variable, they are applied before
+// command line in order of sources
+type configSource struct {
+	name    string
+	args    []string
+	project bool // it's .grrc, which is restricted to projectOptions
+}
+
+// Options, which can be set in .grrc: it's found by walking up from current
+// directory, so it can come with any checked out repository and is not
+// trusted with options, which change files or read arbitrary ones
+var projectOptions = map[string]bool{
+	"ignore-case":           true,
+	"singleline":            true,
+	"plain":                 true,
+	"exclude":               true,
+	"only":                  true,
+	"glob":                  true,
+	"glob-case-insensitive": true,
+	"type":                  true,
+	"type-not":              true,
+	"type-add":              true,
+	"no-autoignore":         true,
+	"no-layer":              true,
+	"layer":                 true,
+	"big-file":              true,
+	"no-bigignore":          true,
+	"diff":                  true,
+	"unified":               true,
+	"verbose":               true,
+	"no-colors":             true,
+	"no-group":              true,
+	"after-context":         true,
+	"before-context":        true,
+	"context":               true,
+	"jobs":                  true,
+	"unordered":             true,
+	"no-stdin":              true,
+}
+
+// Returns sources of default options: user's config file, .grrc of current
+// project and GR_OPTS variable, in this order; none of them are used if
+// --no-config is given
+func configSources(cmdline []string) []*configSource {
+	for _, arg := range cmdline {
+		if arg == "--" {
+			break
+		}
+		if arg == "--no-config" {
+			return nil
+		}
+	}
+
+	var sources []*configSource
+	if dir := userConfigDir(); dir != "" {
+		fp := filepath.Join(dir, "gr", "config")
+		if args, err := readConfigFile(fp); err == nil {
+			sources = append(sources, &configSource{fp, args, false})
+		} else if !os.IsNotExist(err) {
+			errhandle(err, false)
+		}
+	}
+
+	if fp := findProjectConfig(); fp != "" {
+		args, err := readConfigFile(fp)
+		if err == nil {
+			sources = append(sources, &configSource{shortPath(fp), args, true})
+		} else {
+			errhandle(err, false)
+		}
+	}
+
+	if env := os.Getenv(configEnv); env != "" {
+		args, err := splitArgs(env)
+		if err != nil {
+			errhandle(fmt.Errorf("%s: %s", configEnv, err), true)
+		}
+		sources = append(sources, &configSource{configEnv, args, false})
+	}
+	return sources
+}
+
+// Returns $XDG_CONFIG_HOME or ~/.config on every system (and not the one
+// os.UserConfigDir gives on macOS and Windows), so the same path can be
+// documented everywhere
+func userConfigDir() string {
+	if dir := os.Getenv("XDG_CONFIG_HOME"); dir != "" {
+		return dir
+	}
+	if home, err := os.UserHomeDir(); err == nil {
+		return filepath.Join(home, ".config")
+	}
+	return ""
+}
+
+// Config file contains one argument per line, so values can have spaces in
+// them; empty lines and lines starting with "#" are skipped
+func readConfigFile(fp string) ([]string, error) {
+	f, err := os.Open(fp)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var args []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		args = append(args, line)
+	}
+	return args, scanner.Err()
+}
+
+// Splits s into arguments like shell does, but without any expansions: they
+// are separated by spaces, which can be put in single or double quotes or
+// escaped with a backslash
+func splitArgs(s string) ([]string, error) {
+	var args []string
+	var arg strings.Builder
+	inArg := false
+	var quote rune
+	escaped := false
+	for _, c := range s {
+		switch {
+		case escaped:
+			arg.WriteRune(c)
+			escaped = false
+		case c == '\\' && quote != '\'':
+			escaped, inArg = true, true
+		case quote != 0 && c == quote:
+			quote = 0
+		case quote != 0:
+			arg.WriteRune(c)
+		case c == '\'' || c == '"':
+			quote, inArg = c, true
+		case c == ' ' || c == '\t' || c == '\n':
+			if inArg {
+				args = append(args, arg.String())
+				arg.Reset()
+				inArg = false
+			}
+		default:
+			arg.WriteRune(c)
+			inArg = true
+		}
+	}
+	if quote != 0 || escaped {
+		return nil, fmt.Errorf("unterminated quote or escape in '%s'", s)
+	}
+	if inArg {
+		args = append(args, arg.String())
+	}
+	return args, nil
+}
+
+// Looks for .grrc in current directory and its parents
+func findProjectConfig() string {
+	path, err := os.Getwd()
+	if err != nil {
+		return ""
+	}
+	for {
+		fp := filepath.Join(path, projectConfigName)
+		if fi, err := os.Stat(fp); err == nil && !fi.IsDir() {
+			return fp
+		}
+		if filepath.Dir(path) == path { // top directory
+			return ""
+		}
+		path = filepath.Dir(path)
+	}
+}
+
+// Parses args of a single source into a new copy of options, to check them
+// and to see what was set there
+func parseSource(source *configSource) *flags.Parser {
+	parser := flags.NewParser(reflect.New(reflect.TypeOf(opts)).Interface(),
+		flags.None)
+	rest, err := parser.ParseArgs(source.args)
+	if err == nil && len(rest) > 0 && source.name != cmdlineSource {
+		err = fmt.Errorf("only options can be given, not '%s'", rest[0])
+	}
+	if err == nil && source.project {
+		for _, option := range parserOptions(parser) {
+			if option.IsSet() && !projectOptions[option.LongName] {
+				err = fmt.Errorf("option --%s can't be set in %s, only search and display options are allowed there",
+					option.LongName, projectConfigName)
+				break
+			}
+		}
+	}
+	if err != nil {
+		errhandle(fmt.Errorf("%s: %s", source.name, err), true)
+	}
+	return parser
+}
+
+func parserOptions(parser *flags.Parser) []*flags.Option {
+	var options []*flags.Option
+	for _, group := range parser.Groups() {
+		options = append(options, group.Options()...)
+	}
+	return options
+}
+
+// Returns arguments of all sources, which should be parsed before command
+// line; lists (like -x) are joined, while other options given later override
+// earlier ones
+func configArgs(sources []*configSource) []string {
+	var args []string
+	for _, source := range sources {
+		parseSource(source)
+		args = append(args, source.args...)
+	}
+	return args
+}
+
+// a value of option and where it comes from
+type configEntry struct {
+	name   string
+	values []string
+	source string
+}
+
+// Prints options, which are in effect, and their sources
+func printConfig(sources []*configSource, cmdline []string) {
+	all := append(sources, &configSource{cmdlineSource, cmdline, false})
+
+	var entries []*configEntry
+	for _, source := range all {
+		for _, option := range parserOptions(parseSource(source)) {
+			if !option.IsSet() || option.LongName == "print-config" {
+				continue
+			}
+			entry := &configEntry{option.LongName, configValues(option),
+				source.name}
+
+			// only lists are collected from all sources
+			if reflect.TypeOf(option.Value()).Kind() != reflect.Slice {
+				for i, prev := range entries {
+					if prev != nil && prev.name == entry.name {
+						entries[i] = nil
+					}
+				}
+			}
+			entries = append(entries, entry)
+		}
+	}
+
+	for _, entry := range entries {
+		if entry == nil {
+			continue
+		}
+		for _, value := range entry.values {
+			fmt.Printf("%-30s %s\n", value, entry.source)
+		}
+	}
+}
+
+// Formats value of option as it could be given on command line
+func configValues(option *flags.Option) []string {
+	name := "--" + option.LongName
+	switch value := option.Value().(type) {
+	case bool:
+		return []string{name}
+	case []string:
+		values := make([]string, len(value))
+		for i, v := range value {
+			values[i] = name + "=" + v
+		}
+		return values
+	case *string:
+		return []string{name + "=" + *value}
+	case *int:
+		return []string{fmt.Sprintf("%s=%d", name, *value)}
+	}
+	return []string{fmt.Sprintf("%s=%v", name, option.Value())}
+}
@@ -0,0 +1,191 @@
+// (c) 2011-2014 Alexander Solovyov
+// under terms of ISC license
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+)
+
+// Edit replaces content[start:end] with text
+type Edit struct {
+	Start int
+	End   int
+	Text  []byte
+}
+
+// Apply returns content with edits (which should be sorted and should not
+// overlap) applied
+func Apply(content []byte, edits []*Edit) []byte {
+	var res []byte
+	last := 0
+	for _, e := range edits {
+		res = append(res, content[last:e.Start]...)
+		res = append(res, e.Text...)
+		last = e.End
+	}
+	return append(res, content[last:]...)
+}
+
+// changed lines of old content, from and to are line indexes (to is
+// exclusive), lines is what they are replaced with
+type diffBlock struct {
+	from  int
+	to    int
+	lines [][]byte
+}
+
+// splitLines splits s into lines, keeping newlines
+func splitLines(s []byte) [][]byte {
+	var lines [][]byte
+	for len(s) > 0 {
+		i := bytes.IndexByte(s, '\n')
+		if i == -1 {
+			i = len(s) - 1
+		}
+		lines = append(lines, s[:i+1])
+		s = s[i+1:]
+	}
+	return lines
+}
+
+// UnifiedDiff returns diff between content and content with edits applied,
+// suitable for patch -p0, with context lines around changes
+func UnifiedDiff(fn string, content []byte, edits []*Edit, context int) []byte {
+	if len(edits) == 0 {
+		return nil
+	}
+
+	lines := splitLines(content)
+	starts := make([]int, len(lines)+1)
+	for i, line := range lines {
+		starts[i+1] = starts[i] + len(line)
+	}
+	lineOf := func(pos int) int {
+		return sort.Search(len(lines), func(i int) bool {
+			return starts[i+1] > pos
+		})
+	}
+
+	// group edits touching the same lines
+	var blocks []*diffBlock
+	var blockEdits [][]*Edit
+	for _, e := range edits {
+		from, to := lineOf(e.Start), lineOf(e.End-1)+1
+		// zero-width edits (like of \b) change the line they are in, even
+		// at its very beginning or at the end of content
+		if from == len(lines) {
+			from--
+		}
+		if to <= from {
+			to = from + 1
+		}
+		if n := len(blocks); n > 0 && from <= blocks[n-1].to {
+			if to > blocks[n-1].to {
+				blocks[n-1].to = to
+			}
+			blockEdits[n-1] = append(blockEdits[n-1], e)
+			continue
+		}
+		blocks = append(blocks, &diffBlock{from: from, to: to})
+		blockEdits = append(blockEdits, []*Edit{e})
+	}
+
+	for i := 0; i < len(blocks); i++ {
+		b := blocks[i]
+		for {
+			begin := starts[b.from]
+			shifted := make([]*Edit, len(blockEdits[i]))
+			for j, e := range blockEdits[i] {
+				shifted[j] = &Edit{e.Start - begin, e.End - begin, e.Text}
+			}
+			b.lines = splitLines(Apply(content[begin:starts[b.to]], shifted))
+
+			// if newline ending the block was replaced, the next line is
+			// joined to its last line, so it's changed too
+			n := len(b.lines)
+			if n == 0 || bytes.HasSuffix(b.lines[n-1], byteNewLine) ||
+				b.to == len(lines) {
+				break
+			}
+			b.to++
+			if i+1 < len(blocks) && blocks[i+1].from <= b.to {
+				if blocks[i+1].to > b.to {
+					b.to = blocks[i+1].to
+				}
+				blockEdits[i] = append(blockEdits[i], blockEdits[i+1]...)
+				blocks = append(blocks[:i+1], blocks[i+2:]...)
+				blockEdits = append(blockEdits[:i+1], blockEdits[i+2:]...)
+			}
+		}
+	}
+
+	var out bytes.Buffer
+	fmt.Fprintf(&out, "--- %s\n+++ %s\n", fn, fn)
+
+	// line writer, which marks lines without newline at the end
+	write := func(prefix byte, line []byte) {
+		out.WriteByte(prefix)
+		out.Write(line)
+		if len(line) == 0 || line[len(line)-1] != '\n' {
+			out.WriteString("\n\\ No newline at end of file\n")
+		}
+	}
+
+	delta := 0 // difference between new and old line numbers
+	for i := 0; i < len(blocks); {
+		// blocks closer than 2*context lines go into the same hunk
+		j := i + 1
+		for j < len(blocks) && blocks[j].from-blocks[j-1].to <= 2*context {
+			j++
+		}
+
+		from := blocks[i].from - context
+		if from < 0 {
+			from = 0
+		}
+		to := blocks[j-1].to + context
+		if to > len(lines) {
+			to = len(lines)
+		}
+
+		oldCount, newCount := to-from, to-from
+		for _, b := range blocks[i:j] {
+			newCount += len(b.lines) - (b.to - b.from)
+		}
+
+		oldStart, newStart := from+1, from+1+delta
+		if oldCount == 0 {
+			oldStart--
+		}
+		if newCount == 0 {
+			newStart--
+		}
+		fmt.Fprintf(&out, "@@ -%d,%d +%d,%d @@\n", oldStart, oldCount,
+			newStart, newCount)
+
+		pos := from
+		for _, b := range blocks[i:j] {
+			for ; pos < b.from; pos++ {
+				write(' ', lines[pos])
+			}
+			for _, line := range lines[b.from:b.to] {
+				write('-', line)
+			}
+			for _, line := range b.lines {
+				write('+', line)
+			}
+			pos = b.to
+			delta += len(b.lines) - (b.to - b.from)
+		}
+		for ; pos < to; pos++ {
+			write(' ', lines[pos])
+		}
+
+		i = j
+	}
+
+	return out.Bytes()
+}
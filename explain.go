@@ -0,0 +1,215 @@
+// (c) 2011-2014 Alexander Solovyov
+// under terms of ISC license
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	byten "github.com/pyk/byten"
+)
+
+// Explain prints what every layer of ignores and every check of file says
+// about path, and if it's going to be searched in the end. Ignores are those
+// of the root path is in, or of its directory, if it's not in any of them.
+func Explain(path string, roots []*searchRoot, disabled map[string]bool) {
+	fn := filepath.Clean(path)
+	if filepath.IsAbs(fn) {
+		if wd, err := os.Getwd(); err == nil {
+			if rel, err := filepath.Rel(wd, fn); err == nil {
+				fn = rel
+			}
+		}
+	}
+
+	fi, err := os.Lstat(fn)
+	errhandle(err, true)
+
+	root, rel := explainRoot(fn, roots)
+	if root == nil {
+		dir := filepath.Dir(fn)
+		root = &searchRoot{dir, newRootMatcher(dir, true, disabled)}
+		rel = filepath.Base(fn)
+	}
+	stack := root.matcher
+
+	var backuper *Backuper
+	if opts.Backup != "" || opts.BackupDir != "" {
+		backuper = NewBackuper(opts.Backup, opts.BackupDir, opts.BackupOverwrite)
+	}
+
+	// walker never gets inside of skipped directories
+	skipped := false
+	var parents []string
+	for dir := filepath.Dir(rel); dir != "."; dir = filepath.Dir(dir) {
+		parents = append(parents, dir)
+	}
+	for j := len(parents) - 1; j >= 0; j-- {
+		dir := root.shown(parents[j], parents[j])
+		if backuper.IsBackupDir(dir) || stack.Match(dir, true) {
+			fmt.Printf("%s (parent directory)\n", dir)
+			explainBackup(backuper, dir)
+			explainLayers(stack, dir, true)
+			skipped = true
+		}
+	}
+
+	fn = root.shown(rel, rel)
+	fmt.Println(fn)
+	if fi.IsDir() && explainBackup(backuper, fn) {
+		skipped = true
+	}
+	if explainLayers(stack, fn, fi.IsDir()) {
+		skipped = true
+	}
+	if !fi.IsDir() && explainFile(fn, fi) {
+		skipped = true
+	}
+
+	if skipped {
+		fmt.Println("skipped")
+	} else {
+		fmt.Println("searched")
+	}
+}
+
+// Finds root fn is in (or which is fn itself) and returns it with fn relative
+// to it
+func explainRoot(fn string, roots []*searchRoot) (*searchRoot, string) {
+	for _, root := range roots {
+		if root.path == stdinPath {
+			continue
+		}
+		rel, err := filepath.Rel(filepath.Clean(root.path), fn)
+		if err != nil || rel == ".." ||
+			strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			continue
+		}
+		if fi, err := os.Stat(root.path); err == nil && !fi.IsDir() && rel != "." {
+			continue
+		}
+		return root, rel
+	}
+	return nil, ""
+}
+
+// backup directory is reported only when backups are made
+func explainBackup(backuper *Backuper, dir string) (skipped bool) {
+	switch {
+	case backuper == nil:
+	case backuper.IsBackupDir(dir):
+		explainLine("backup", "yes (--backup-dir)")
+		return true
+	default:
+		explainLine("backup", "no")
+	}
+	return false
+}
+
+func explainLine(name string, verdict string) {
+	fmt.Printf("  %-10s%s\n", name+":", verdict)
+}
+
+func explainLayers(stack *MatcherStack, fn string, isdir bool) (skipped bool) {
+	for _, layer := range stack.layers {
+		switch {
+		case layer.disabled:
+			explainLine(layer.name, "disabled")
+		case layer.matcher == nil:
+			explainLine(layer.name, "not used")
+		default:
+			ignored, reason := layer.matcher.Explain(layer.path(fn, stack.rel(fn)),
+				isdir)
+			verdict := "not ignored"
+			if ignored {
+				verdict = "ignored"
+				skipped = true
+			}
+			if reason != "" {
+				verdict += " (" + reason + ")"
+			}
+			explainLine(layer.name, verdict)
+		}
+	}
+	return skipped
+}
+
+// repeats checks of AcceptFile and VisitFile
+func explainFile(fn string, fi os.FileInfo) (skipped bool) {
+	if fi.Size() == 0 && !opts.FindFiles {
+		explainLine("empty", "yes")
+		return true
+	}
+	explainLine("empty", "no")
+
+	if opts.FindFiles {
+		return false
+	}
+
+	if fi.Mode()&os.ModeSymlink != 0 {
+		target, err := os.Stat(fn)
+		if err != nil {
+			explainLine("symlink", fmt.Sprintf("yes, invalid (%s)", err))
+			return true
+		}
+		dest, _ := os.Readlink(fn)
+		explainLine("symlink", "yes, to "+dest)
+		fi = target
+	} else {
+		explainLine("symlink", "no")
+	}
+
+	size := byten.Size(fi.Size())
+	switch {
+	case fi.Size() >= BigFileSize && opts.NoBigIgnores:
+		explainLine("big", fmt.Sprintf("yes (%s, limit is %s), read whole (-B)",
+			size, byten.Size(BigFileSize)))
+	case fi.Size() >= BigFileSize && len(opts.Replace) > 0:
+		explainLine("big", fmt.Sprintf("yes (%s, limit is %s), can't replace in it",
+			size, byten.Size(BigFileSize)))
+		return true
+	case fi.Size() >= BigFileSize:
+		explainLine("big", fmt.Sprintf("yes (%s, limit is %s), searched line by line",
+			size, byten.Size(BigFileSize)))
+		return false
+	default:
+		explainLine("big", fmt.Sprintf("no (%s, limit is %s)", size,
+			byten.Size(BigFileSize)))
+	}
+
+	content, err := ioutil.ReadFile(fn)
+	switch {
+	case err != nil:
+		explainLine("binary", fmt.Sprintf("unreadable (%s)", err))
+		return true
+	case bytes.IndexByte(content, 0) == -1:
+		explainLine("binary", "no")
+	case opts.Force:
+		explainLine("binary", "yes")
+	default:
+		explainLine("binary",
+			"yes (matching lines are not printed, replacing needs --force)")
+	}
+	return false
+}
+
+// Makes fp relative to current directory, if it's inside of it
+func shortPath(fp string) string {
+	if !filepath.IsAbs(fp) {
+		return fp
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		return fp
+	}
+	rel, err := filepath.Rel(wd, fp)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, "../") {
+		return fp
+	}
+	return rel
+}
@@ -0,0 +1,138 @@
+// (c) 2011-2014 Alexander Solovyov
+// under terms of ISC license
+
+package main
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Reads value of key (like "core.excludesFile") from git config files, in
+// order of their precedence: user's global config, then repository's one.
+// It's not a full config parser, only enough to read simple keys.
+func gitConfigValue(gitdir string, key string) (value string, found bool) {
+	for _, fp := range gitConfigFiles(gitdir) {
+		if v, ok := readGitConfig(fp, key); ok {
+			value, found = v, true
+		}
+	}
+	return value, found
+}
+
+func gitConfigFiles(gitdir string) []string {
+	var files []string
+	if xdg := xdgConfigHome(); xdg != "" {
+		files = append(files, filepath.Join(xdg, "git", "config"))
+	}
+	if home, err := os.UserHomeDir(); err == nil {
+		files = append(files, filepath.Join(home, ".gitconfig"))
+	}
+	return append(files, filepath.Join(gitdir, "config"))
+}
+
+func xdgConfigHome() string {
+	if xdg := os.Getenv("XDG_CONFIG_HOME"); xdg != "" {
+		return xdg
+	}
+	if home, err := os.UserHomeDir(); err == nil {
+		return filepath.Join(home, ".config")
+	}
+	return ""
+}
+
+func readGitConfig(fp string, key string) (value string, found bool) {
+	dot := strings.LastIndexByte(key, '.')
+	section, name := strings.ToLower(key[:dot]), strings.ToLower(key[dot+1:])
+
+	f, err := os.Open(fp)
+	if err != nil {
+		return "", false
+	}
+	defer f.Close()
+
+	current := ""
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || line[0] == '#' || line[0] == ';' {
+			continue
+		}
+
+		if line[0] == '[' {
+			end := strings.IndexByte(line, ']')
+			if end == -1 {
+				continue
+			}
+			// subsections ([remote "origin"]) are not interesting here
+			current = strings.ToLower(strings.Fields(line[1:end] + " ")[0])
+			continue
+		}
+
+		if current != section {
+			continue
+		}
+
+		eq := strings.IndexByte(line, '=')
+		if eq == -1 || strings.ToLower(strings.TrimSpace(line[:eq])) != name {
+			continue
+		}
+		value, found = parseGitConfigValue(line[eq+1:]), true
+	}
+	return value, found
+}
+
+// strips comments and quotes from value
+func parseGitConfigValue(s string) string {
+	var res strings.Builder
+	quoted := false
+	s = strings.TrimSpace(s)
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '"':
+			quoted = !quoted
+		case c == '\\' && i+1 < len(s):
+			i++
+			switch s[i] {
+			case 'n':
+				res.WriteByte('\n')
+			case 't':
+				res.WriteByte('\t')
+			default:
+				res.WriteByte(s[i])
+			}
+		case (c == '#' || c == ';') && !quoted:
+			return strings.TrimSpace(res.String())
+		default:
+			res.WriteByte(c)
+		}
+	}
+	return strings.TrimSpace(res.String())
+}
+
+// expands ~/ in paths from git config
+func expandHome(path string) string {
+	if !strings.HasPrefix(path, "~/") {
+		return path
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return path
+	}
+	return filepath.Join(home, path[2:])
+}
+
+// Returns path to global ignore file, which is core.excludesFile or
+// $XDG_CONFIG_HOME/git/ignore if it's not set
+func gitExcludesFile(gitdir string) string {
+	if path, ok := gitConfigValue(gitdir, "core.excludesFile"); ok {
+		return expandHome(path)
+	}
+	if xdg := xdgConfigHome(); xdg != "" {
+		return filepath.Join(xdg, "git", "ignore")
+	}
+	return ""
+}
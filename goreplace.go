@@ -6,10 +6,7 @@ package main
 import (
 	"bytes"
 	"fmt"
-	"math"
 	"os"
-	"path/filepath"
-	"regexp"
 	"runtime"
 	"strconv"
 
@@ -27,22 +24,55 @@ var NoColors = false
 var BigFileSize = int64(10 * 1024 * 1024)
 
 var opts struct {
-	Replace         *string  `short:"r" long:"replace" description:"replace found substrings with RE" value-name:"RE"`
+	Replace         []string `short:"r" long:"replace" description:"replace found substrings with RE (multi, one per -e)" value-name:"RE"`
 	Force           bool     `short:""  long:"force" description:"force replacement in binary files"`
-	DryRun          bool     `short:""  long:"dry-run" description:"prints replacements without modifying files"`
+	DryRun          bool     `short:""  long:"dry-run" description:"print diff of replacements without modifying files"`
+	Diff            bool     `short:""  long:"diff" description:"print replacements as unified diff"`
+	DiffContext     *int     `short:"U" long:"unified" description:"show N lines of context in diff (default: 3)" value-name:"N"`
+	Undo            bool     `short:""  long:"undo" description:"undo replacements made by the last run"`
+	Interactive     bool     `short:""  long:"interactive" description:"ask before every replacement"`
+	Backup          string   `short:""  long:"backup" description:"save original files with SUFFIX (default: ~)" value-name:"SUFFIX" optional:"yes" optional-value:"~"`
+	BackupDir       string   `short:""  long:"backup-dir" description:"save original files to DIR" value-name:"DIR"`
+	BackupOverwrite bool     `short:""  long:"backup-overwrite" description:"overwrite existing backups"`
+	Links           string   `short:""  long:"links" description:"how to write to links: follow (default), replace" value-name:"MODE"`
+	Patterns        []string `short:"e" long:"regexp" description:"search for PATTERN (multi)" value-name:"PATTERN"`
+	PatternFiles    []string `short:"F" long:"file" description:"read patterns from FILE, one per line (multi)" value-name:"FILE"`
 	IgnoreCase      bool     `short:"i" long:"ignore-case" description:"ignore pattern case"`
 	SingleLine      bool     `short:"s" long:"singleline" description:"^/$ will match beginning/end of line"`
 	PlainText       bool     `short:"p" long:"plain" description:"treat pattern as plain text"`
 	IgnoreFiles     []string `short:"x" long:"exclude" description:"exclude filenames that match regexp RE (multi)" value-name:"RE"`
 	AcceptFiles     []string `short:"o" long:"only" description:"search only filenames that match regexp RE (multi)" value-name:"RE"`
-	NoGlobalIgnores bool     `short:"I" long:"no-autoignore" description:"do not read .git/.hgignore files"`
-	BigFileSize     *string  `short:"b" long:"big-file" description:"ignore files bigger than SIZE (use suffixes: k, M)" value-name:"SIZE"`
-	NoBigIgnores    bool     `short:"B" long:"no-bigignore" description:"do not ignore big files at all"`
+	Globs           []string `short:"g" long:"glob" description:"search only files matching GLOB, skip ones matching !GLOB (multi)" value-name:"GLOB"`
+	GlobCaseFold    bool     `short:""  long:"glob-case-insensitive" description:"ignore case in -g globs"`
+	Types           []string `short:"t" long:"type" description:"search only files of type TYPE (multi)" value-name:"TYPE"`
+	NotTypes        []string `short:"T" long:"type-not" description:"do not search files of type TYPE (multi)" value-name:"TYPE"`
+	TypeAdd         []string `short:""  long:"type-add" description:"define type as NAME:GLOB[,GLOB...] (multi)" value-name:"DEF"`
+	TypeList        bool     `short:""  long:"type-list" description:"print known file types"`
+	NoGlobalIgnores bool     `short:"I" long:"no-autoignore" description:"do not read .gitignore/.hgignore/.ignore files"`
+	NoLayers        []string `short:""  long:"no-layer" description:"disable ignore layer NAME: general, vcs, project, exclude, only, glob or type (multi)" value-name:"NAME"`
+	Layers          []string `short:""  long:"layer" description:"re-enable ignore layer NAME (multi)" value-name:"NAME"`
+	Explain         string   `short:""  long:"explain" description:"explain why PATH is searched or skipped" value-name:"PATH"`
+	ListFiles       bool     `short:""  long:"files" description:"print files which would be searched"`
+	ListIgnored     bool     `short:""  long:"list-ignored" description:"print skipped files and directories with reasons"`
+	Null            bool     `short:"0" long:"null" description:"separate names with NUL in --files/--list-ignored"`
+	BigFileSize     *string  `short:"b" long:"big-file" description:"search files bigger than SIZE line by line and don't replace in them (use suffixes: k, M)" value-name:"SIZE"`
+	NoBigIgnores    bool     `short:"B" long:"no-bigignore" description:"read big files whole, like any other"`
 	FindFiles       bool     `short:"f" long:"find-files" description:"search in file names"`
+	WithoutMatch    bool     `short:"L" long:"files-without-match" description:"print only names of files without matches"`
+	InvertMatch     bool     `short:""  long:"invert-match" description:"print lines which don't match"`
 	OnlyName        bool     `short:"n" long:"filename" description:"print only filenames"`
 	Verbose         bool     `short:"v" long:"verbose" description:"show non-fatal errors (like unreadable files)"`
 	NoColors        bool     `short:"c" long:"no-colors" description:"do not show colors in output"`
 	NoGroup         bool     `short:"N" long:"no-group" description:"print file name before each line"`
+	JSON            bool     `short:""  long:"json" description:"print results as JSON Lines"`
+	AfterContext    int      `short:"A" long:"after-context" description:"print N lines after each match" value-name:"N"`
+	BeforeContext   int      `short:""  long:"before-context" description:"print N lines before each match" value-name:"N"`
+	Context         int      `short:"C" long:"context" description:"print N lines around each match" value-name:"N"`
+	Jobs            int      `short:"j" long:"jobs" description:"search N files in parallel (default: number of CPUs)" value-name:"N"`
+	Unordered       bool     `short:""  long:"unordered" description:"print results as they come, not in path order"`
+	NoStdin         bool     `short:""  long:"no-stdin" description:"do not search piped standard input when no paths are given"`
+	NoConfig        bool     `short:""  long:"no-config" description:"do not read config files and $GR_OPTS"`
+	PrintConfig     bool     `short:""  long:"print-config" description:"print options in effect and where they come from"`
 	ShowVersion     bool     `short:"V" long:"version" description:"show version and exit"`
 	ShowHelp        bool     `short:"h" long:"help" description:"show this help message"`
 }
@@ -50,11 +80,18 @@ var opts struct {
 var argparser = flags.NewParser(&opts, flags.PrintErrors|flags.PassDoubleDash)
 
 func main() {
-	args, err := argparser.Parse()
+	cmdline := os.Args[1:]
+	sources := configSources(cmdline)
+	args, err := argparser.ParseArgs(append(configArgs(sources), cmdline...))
 	if err != nil {
 		os.Exit(1)
 	}
 
+	if opts.PrintConfig {
+		printConfig(sources, cmdline)
+		return
+	}
+
 	if opts.ShowVersion {
 		fmt.Printf("goreplace %s\n", Version)
 		return
@@ -65,54 +102,100 @@ func main() {
 		BigFileSize = parseFileSize(opts.BigFileSize)
 	}
 
-	cwd, _ := os.Getwd()
-	ignoreFileMatcher := NewMatcher(cwd, opts.NoGlobalIgnores)
-	ignoreFileMatcher.Append(opts.IgnoreFiles)
-
-	acceptedFileMatcher := NewGeneralMatcher([]string{}, []string{})
-	if len(opts.AcceptFiles) > 0 {
-		acceptedFileMatcher.Append(opts.AcceptFiles)
-	} else {
-		acceptedFileMatcher.Append([]string{".*"})
+	errhandle(checkLayers(append(opts.NoLayers, opts.Layers...)), true)
+	disabled := make(map[string]bool)
+	if opts.NoGlobalIgnores {
+		disabled["vcs"], disabled["project"] = true, true
+	}
+	for _, name := range opts.NoLayers {
+		disabled[name] = true
+	}
+	for _, name := range opts.Layers {
+		disabled[name] = false
+	}
+	for _, def := range opts.TypeAdd {
+		errhandle(AddFileType(def), true)
+	}
+	if opts.TypeList {
+		printFileTypes()
+		return
 	}
 
-	ignoreSizeText := fmt.Sprintf("Ignoring files bigger than %s\n",
+	ignoreFileMatcher := NewMatcherStack(".", disabled, opts.IgnoreFiles,
+		opts.AcceptFiles, NewGlobMatcher(opts.Globs, opts.GlobCaseFold),
+		NewTypeMatcher(opts.Types, opts.NotTypes))
+
+	ignoreSizeText := fmt.Sprintf("Searching files bigger than %s line by line\n",
 		byten.Size(BigFileSize))
 	if opts.NoBigIgnores {
 		ignoreSizeText = ""
 	}
-	argparser.Usage = fmt.Sprintf("[OPTIONS] string-to-search\n\n%s%s",
+	argparser.Usage = fmt.Sprintf("[OPTIONS] string-to-search [PATH...]\n\n%s%s",
 		ignoreSizeText, ignoreFileMatcher)
 
-	if opts.ShowHelp || len(args) == 0 {
-		argparser.WriteHelp(os.Stdout)
+	if opts.Explain != "" {
+		Explain(opts.Explain,
+			NewSearchRoots(searchPaths(args), ignoreFileMatcher, disabled), disabled)
 		return
 	}
 
-	arg := args[0]
-	if opts.PlainText {
-		arg = regexp.QuoteMeta(arg)
+	if opts.ListFiles || opts.ListIgnored {
+		listFiles(NewSearchRoots(searchPaths(args), ignoreFileMatcher, disabled))
+		return
+	}
+
+	if opts.Undo {
+		printer := &TextPrinter{NoColors: NoColors, out: os.Stdout}
+		errhandle(Undo(printer), true)
+		return
+	}
+
+	// with -e or -F all arguments are paths
+	pats := opts.Patterns
+	for _, fp := range opts.PatternFiles {
+		filePats, err := readPatterns(fp)
+		errhandle(err, true)
+		pats = append(pats, filePats...)
+	}
+	if len(opts.Patterns) == 0 && len(opts.PatternFiles) == 0 && len(args) > 0 {
+		pats, args = args[:1], args[1:]
 	}
-	if opts.IgnoreCase {
-		arg = "(?i:" + arg + ")"
+
+	if opts.ShowHelp || len(pats) == 0 {
+		argparser.WriteHelp(os.Stdout)
+		return
 	}
 
-	pattern, err := regexp.Compile(arg)
+	pattern, err := NewPattern(pats, unquoteReplaces(opts.Replace))
 	errhandle(err, true)
 
-	if pattern.Match([]byte("")) {
-		errhandle(fmt.Errorf("Your pattern matches empty string"), true)
+	if len(opts.Replace) > 0 && (opts.InvertMatch || opts.WithoutMatch) {
+		errhandle(fmt.Errorf("Can't replace with --invert-match or --files-without-match"),
+			true)
+	}
+
+	switch opts.Links {
+	case "":
+		opts.Links = LinksFollow
+	case LinksFollow, LinksReplace:
+	default:
+		errhandle(fmt.Errorf("Unknown --links mode '%s'", opts.Links), true)
 	}
 
-	if opts.Replace != nil {
-		s, err := strconv.Unquote(`"` + *opts.Replace + `"`)
-		if err != nil {
-			errhandle(err, true)
-		}
-		*opts.Replace = s
+	paths := args
+	if len(paths) == 0 && !opts.NoStdin && stdinPiped() {
+		paths = []string{stdinPath}
 	}
+	searchFiles(pattern,
+		NewSearchRoots(searchPaths(paths), ignoreFileMatcher, disabled))
+}
 
-	searchFiles(pattern, ignoreFileMatcher, acceptedFileMatcher)
+// paths given on command line, current directory by default
+func searchPaths(args []string) []string {
+	if len(args) == 0 {
+		return []string{"."}
+	}
+	return args
 }
 
 func errhandle(err error, exit bool) bool {
@@ -151,121 +234,246 @@ func parseFileSize(suffixedFileSize *string) int64 {
 	return fileSize
 }
 
-func searchFiles(pattern *regexp.Regexp, ignoreFileMatcher Matcher,
-	acceptedFileMatcher Matcher) {
+func searchFiles(pattern *Pattern, roots []*searchRoot) {
 
-	printer := &Printer{NoColors, opts.NoGroup, ""}
-	v := &GRVisitor{printer, pattern, ignoreFileMatcher, acceptedFileMatcher}
+	var printer Printer
+	if opts.JSON {
+		printer = NewJSONPrinter(os.Stdout)
+	} else {
+		printer = &TextPrinter{NoColors: NoColors, NoGroup: opts.NoGroup,
+			ShowDiff: opts.Diff || opts.DryRun, out: os.Stdout}
+	}
+	v := &GRVisitor{printer, pattern, nil, nil, nil, nil}
+	if opts.Backup != "" || opts.BackupDir != "" {
+		v.backuper = NewBackuper(opts.Backup, opts.BackupDir, opts.BackupOverwrite)
+	}
 
 	if opts.DryRun {
-		printer.Printf("Searching for: %s\n", "Searching for: %s\n", pattern.String())
-		if opts.Replace != nil {
-			printer.Printf("Replacing with: %s\n", "Replacing with: %s\n", *opts.Replace)
+		printer.Notice("Searching for: %s\n", "Searching for: %s\n", pattern.String())
+		if len(opts.Replace) > 0 {
+			printer.Notice("Replacing with: %s\n", "Replacing with: %s\n",
+				pattern.Replaces())
 		}
 	}
 
-	err := filepath.Walk(".", v.Walk)
-	errhandle(err, false)
-}
-
-type GRVisitor struct {
-	printer             *Printer
-	pattern             *regexp.Regexp
-	ignoreFileMatcher   Matcher
-	acceptedFileMatcher Matcher
-	// errors              chan error
-}
+	if len(opts.Replace) > 0 && !opts.DryRun {
+		journal, err := NewJournal(pattern.String(), pattern.Replaces())
+		if err != nil {
+			errhandle(fmt.Errorf("Can't keep journal, --undo won't work: %s", err),
+				false)
+		} else {
+			v.journal = journal
+			defer journal.Close()
+		}
+	}
 
-func (v *GRVisitor) Walk(fn string, fi os.FileInfo, err error) error {
-	if err != nil {
-		if opts.Verbose {
-			errhandle(err, false)
+	if opts.Interactive && len(opts.Replace) > 0 {
+		context := opts.Context
+		if context == 0 {
+			context = 2
+		}
+		prompter, err := NewPrompter(context)
+		if err != nil {
+			errhandle(fmt.Errorf("Can't open terminal for --interactive: %s", err),
+				true)
 		}
-		return nil
+		v.prompter = prompter
 	}
+	jobs := v.jobs()
 
-	if fi.IsDir() {
-		if !v.VisitDir(fn, fi) {
-			return filepath.SkipDir
+	// standard input is searched on its own, in between of other roots
+	start, grouped := 0, false
+	for i := 0; i <= len(roots); i++ {
+		if i < len(roots) && roots[i].path != stdinPath {
+			continue
 		}
-		return nil
+		if i > start {
+			var err error
+			grouped, err = v.Run(roots[start:i], jobs, !opts.Unordered,
+				os.Stdout, grouped)
+			errhandle(err, false)
+		}
+		if i < len(roots) {
+			grouped = v.SearchStdin(grouped)
+		}
+		start = i + 1
 	}
+	printer.Summary()
+}
 
-	v.VisitFile(fn, fi)
-	return nil
+type GRVisitor struct {
+	printer           Printer
+	pattern           *Pattern
+	ignoreFileMatcher Matcher
+	backuper          *Backuper
+	prompter          *Prompter
+	journal           *Journal
+}
+
+// number of files to process in parallel, questions of --interactive should
+// be asked one by one
+func (v *GRVisitor) jobs() int {
+	switch {
+	case v.prompter != nil:
+		return 1
+	case opts.Jobs == 0:
+		return runtime.GOMAXPROCS(0)
+	}
+	return opts.Jobs
 }
 
 func (v *GRVisitor) VisitDir(fn string, fi os.FileInfo) bool {
+	if v.backuper != nil && v.backuper.IsBackupDir(fn) {
+		return false
+	}
 	return !v.ignoreFileMatcher.Match(fn, true)
 }
 
-func (v *GRVisitor) VisitFile(fn string, fi os.FileInfo) {
+// SkipReason tells why file or directory is skipped, repeating checks of
+// VisitDir, AcceptFile and VisitFile (except reading contents); returns empty
+// string if it's not skipped
+func (v *GRVisitor) SkipReason(fn string, fi os.FileInfo) string {
+	if fi.IsDir() {
+		if v.backuper != nil && v.backuper.IsBackupDir(fn) {
+			return "backup directory"
+		}
+		if v.ignoreFileMatcher.Match(fn, true) {
+			_, reason := v.ignoreFileMatcher.Explain(fn, true)
+			return reason
+		}
+		return ""
+	}
+
 	if fi.Size() == 0 && !opts.FindFiles {
-		return
+		return "empty"
 	}
 
 	if v.ignoreFileMatcher.Match(fn, false) {
-		return
+		_, reason := v.ignoreFileMatcher.Explain(fn, false)
+		return reason
 	}
 
-	if !v.acceptedFileMatcher.Match(fn, false) {
-		return
+	if opts.FindFiles {
+		return ""
 	}
 
-	if opts.FindFiles {
-		v.SearchFileName(fn)
+	if fi.Mode()&os.ModeSymlink != 0 {
+		target, err := os.Stat(fn)
+		if err != nil {
+			return "invalid symlink"
+		}
+		fi = target
+	}
+
+	if !opts.NoBigIgnores && fi.Size() >= BigFileSize && len(opts.Replace) > 0 {
+		return "too big: " + byten.Size(fi.Size())
+	}
+	return ""
+}
+
+// AcceptFile is called by the walker and decides if file should be handed to
+// a worker at all, so it should be cheap
+func (v *GRVisitor) AcceptFile(fn string, fi os.FileInfo) bool {
+	if fi.Size() == 0 && !opts.FindFiles {
+		return false
+	}
+
+	return !v.ignoreFileMatcher.Match(fn, false)
+}
+
+// VisitFile is called by workers for files, which passed AcceptFile
+func (v *GRVisitor) VisitFile(fn string, fi os.FileInfo) {
+	if v.prompter != nil && v.prompter.Quit() {
 		return
 	}
 
-	if !opts.NoBigIgnores && fi.Size() >= BigFileSize {
-		errhandle(fmt.Errorf("Skipping %s, too big: %s\n", fn, byten.Size(fi.Size())),
-			false)
+	if opts.FindFiles {
+		v.SearchFileName(fn)
 		return
 	}
 
-	// just skip invalid symlinks
+	// just skip invalid symlinks, and look at target of valid ones
 	if fi.Mode()&os.ModeSymlink != 0 {
-		if _, err := os.Stat(fn); err != nil {
+		target, err := os.Stat(fn)
+		if err != nil {
 			if opts.Verbose {
 				errhandle(err, false)
 			}
 			return
 		}
+		fi = target
+	}
+
+	// big files are searched line by line by chunks instead of being read
+	// whole (and are skipped when replacing), unless -B is given
+	if fi.Size() >= BigFileSize && !opts.NoBigIgnores {
+		if len(opts.Replace) > 0 {
+			errhandle(fmt.Errorf("Skipping %s, too big: %s\n", fn,
+				byten.Size(fi.Size())), false)
+			return
+		}
+		errhandle(fmt.Errorf("Searching %s line by line, too big: %s\n", fn,
+			byten.Size(fi.Size())), false)
+		v.SearchBigFile(fn)
+		return
 	}
 
 	f, content := v.GetFileAndContent(fn, fi)
 	if f == nil {
 		return
 	}
-	defer f.Close()
+	// file can't be renamed over while it's open on Windows
+	f.Close()
 
-	if opts.Replace == nil {
+	if len(opts.Replace) == 0 {
 		v.SearchFile(fn, content)
 		return
 	}
 
-	changed, result := v.ReplaceInFile(fn, content)
-	if changed && !opts.DryRun {
-		f.Seek(0, 0)
-		n, err := f.Write(result)
+	result, edits := v.ReplaceInFile(fn, content)
+	if len(edits) > 0 && !opts.DryRun {
+		if v.backuper != nil {
+			err := v.backuper.Backup(fn, content)
+			if err != nil {
+				errhandle(fmt.Errorf("Error making backup of '%s', skipping: %s",
+					fn, err), false)
+				return
+			}
+		}
+
+		if v.journal != nil {
+			err := v.journal.Record(fn, content, result, edits)
+			if err != nil {
+				errhandle(fmt.Errorf("Error writing journal, skipping '%s': %s",
+					fn, err), false)
+				return
+			}
+		}
+
+		err := WriteFile(fn, result, opts.Links)
 		if err != nil {
 			errhandle(fmt.Errorf("Error writing replacement to file '%s': %s",
 				fn, err), true)
 		}
-		if int64(n) < fi.Size() {
-			err := f.Truncate(int64(n))
-			if err != nil {
-				errhandle(fmt.Errorf("Error truncating file '%s' to size %d",
-					fn, n), true)
-			}
+	}
+}
+
+func (v *GRVisitor) SearchBigFile(fn string) {
+	f, err := os.Open(fn)
+	if err != nil {
+		if opts.Verbose {
+			errhandle(err, false)
 		}
+		return
 	}
+	defer f.Close()
+	v.SearchStream(fn, f)
 }
 
 func (v *GRVisitor) GetFileAndContent(fn string, fi os.FileInfo) (f *os.File, content []byte) {
 	var err error
 
-	if opts.Replace != nil {
+	if len(opts.Replace) > 0 {
 		f, err = os.OpenFile(fn, os.O_RDWR, 0666)
 	} else {
 		f, err = os.Open(fn)
@@ -282,7 +490,8 @@ func (v *GRVisitor) GetFileAndContent(fn string, fi os.FileInfo) (f *os.File, co
 	n, err := f.Read(content)
 	if err != nil {
 		errhandle(fmt.Errorf("Error %s", err), false)
-		return
+		f.Close()
+		return nil, nil
 	}
 	if int64(n) != fi.Size() {
 		errhandle(fmt.Errorf("Not whole file '%s' was read, only %d from %d",
@@ -293,59 +502,131 @@ func (v *GRVisitor) GetFileAndContent(fn string, fi os.FileInfo) (f *os.File, co
 }
 
 func (v *GRVisitor) SearchFile(fn string, content []byte) {
-	seen := NewIntSet()
-	binary := bytes.IndexByte(content, 0) != -1
-	found := v.FindAllIndex(content)
-	idxFmt := "%d:"
+	stats := &FileStats{}
+	defer v.printer.End(fn, stats)
 
-	if !opts.NoGroup {
-		maxVal := 0
-		for _, info := range found {
-			if info.num > maxVal {
-				maxVal = info.num
-			}
+	var found []*LineInfo
+	if opts.InvertMatch {
+		found = v.invertFindAllIndex(content)
+	} else {
+		found = v.FindAllIndex(content)
+	}
+
+	if opts.WithoutMatch {
+		if len(found) == 0 {
+			v.printer.FileName(fn)
 		}
-		idxLength := int(math.Ceil(math.Log10(float64(maxVal))))
-		idxFmt = fmt.Sprintf("%%%dd:", idxLength)
+		return
+	}
+	if len(found) == 0 {
+		return
 	}
 
+	stats.Lines = len(found)
 	for _, info := range found {
-		if !seen.Add(info.num) {
-			continue
-		}
+		stats.Matches += len(info.matches)
+	}
+	if opts.InvertMatch {
+		stats.Matches = stats.Lines
+	}
 
-		if binary && !opts.OnlyName {
-			fmt.Printf("Binary file '%s' matches\n", fn)
-			return
+	if opts.OnlyName {
+		v.printer.FileName(fn)
+		return
+	}
+
+	if bytes.IndexByte(content, 0) != -1 {
+		v.printer.BinaryMatch(fn)
+		return
+	}
+
+	before, after := contextSize()
+	v.printer.Begin(fn, found[len(found)-1].num+after)
+
+	// last printed line, its end and how many lines of after-context it wants
+	last, lastEnd, pending := 0, 0, 0
+
+	for _, info := range found {
+		for ; pending > 0 && last+1 < info.num; pending-- {
+			lastEnd = v.printContextLine(fn, content, last+1, lastEnd)
+			last++
 		}
 
-		if opts.OnlyName {
-			v.printer.Printf("@g%s\n", "%s\n", fn)
-			return
+		if before > 0 || after > 0 {
+			first := info.num - before
+			if first <= last {
+				first = last + 1
+			}
+			if last > 0 && first > last+1 {
+				v.printer.Break(fn)
+			}
+
+			begin := info.begin
+			for i := first; i < info.num; i++ {
+				begin = bytes.LastIndexByte(content[:begin-1], '\n') + 1
+			}
+			for i, end := first, begin-1; i < info.num; i++ {
+				end = v.printContextLine(fn, content, i, end)
+			}
 		}
 
-		colored := v.pattern.ReplaceAllStringFunc(string(info.line),
-			func(wrap string) string {
-				return v.printer.Sprintf("@Y%s", "%s", wrap)
-			})
+		v.printer.Match(fn, info)
+
+		last = info.num + countLines(info.line)
+		lastEnd = info.end
+		pending = after
+	}
 
-		v.printer.FilePrintf(fn,
-			"@!@y"+idxFmt+"@|%s\n",
-			idxFmt+"%s\n",
-			info.num,
-			colored)
+	for ; pending > 0 && lastEnd+1 < len(content); pending-- {
+		lastEnd = v.printContextLine(fn, content, last+1, lastEnd)
+		last++
 	}
 }
 
+// Prints line number num, which starts right after prevEnd, as a context line
+// and returns where it ends
+func (v *GRVisitor) printContextLine(fn string, content []byte,
+	num int, prevEnd int) int {
+
+	begin := prevEnd + 1
+	end := bytes.IndexByte(content[begin:], '\n')
+	if end == -1 {
+		end = len(content)
+	} else {
+		end += begin
+	}
+
+	v.printer.Context(fn, num, content[begin:end])
+	return end
+}
+
+func contextSize() (before int, after int) {
+	before, after = opts.Context, opts.Context
+	if opts.BeforeContext > 0 {
+		before = opts.BeforeContext
+	}
+	if opts.AfterContext > 0 {
+		after = opts.AfterContext
+	}
+	return before, after
+}
+
 func (v *GRVisitor) SearchFileName(fn string) {
-	if !v.pattern.MatchString(fn) {
+	stats := &FileStats{}
+	defer v.printer.End(fn, stats)
+
+	matches := v.pattern.FindAllStringIndex(fn)
+	if opts.WithoutMatch {
+		if matches == nil {
+			v.printer.FileName(fn)
+		}
 		return
 	}
-	colored := v.pattern.ReplaceAllStringFunc(fn,
-		func(wrap string) string {
-			return v.printer.Sprintf("@Y%s", "%s", wrap)
-		})
-	fmt.Println(colored)
+	if matches == nil {
+		return
+	}
+	stats.Matches = len(matches)
+	v.printer.FoundName(fn, matches)
 }
 
 func getSuffix(num int) string {
@@ -355,7 +636,7 @@ func getSuffix(num int) string {
 	return ""
 }
 
-func (v *GRVisitor) ReplaceInFile(fn string, content []byte) (changed bool, result []byte) {
+func (v *GRVisitor) ReplaceInFile(fn string, content []byte) (result []byte, edits []*Edit) {
 	if opts.SingleLine {
 		errhandle(fmt.Errorf("Can't handle singleline replacements"),
 			true)
@@ -366,41 +647,78 @@ func (v *GRVisitor) ReplaceInFile(fn string, content []byte) (changed bool, resu
 			true)
 	}
 
-	changed = false
-	changenum := 0
-	binary := bytes.IndexByte(content, 0) != -1
+	stats := &FileStats{}
+	defer v.printer.End(fn, stats)
 
-	if binary && !opts.Force {
+	if bytes.IndexByte(content, 0) != -1 && !opts.Force {
 		errhandle(
 			fmt.Errorf("%s - binary file skipped, supply --force to force change", fn),
 			false)
-		return changed, content
+		return content, nil
 	}
 
-	result = v.pattern.ReplaceAllFunc(content, func(s []byte) []byte {
-		if !changed {
-			changed = true
-			v.printer.Printf("@g%s\n", "%s\n", fn)
+	var confirmer *Confirmer
+	if v.prompter != nil {
+		confirmer = v.prompter.ForFile(fn)
+	}
+
+	linenum, counted := 1, 0
+	matches, which := v.pattern.FindAll(content)
+	for i, bounds := range matches {
+		linenum += countLines(content[counted:bounds[0]])
+		counted = bounds[0]
+
+		changedTo := v.pattern.Expand(content, bounds, which, i)
+		replace, more := confirmer.Confirm(content, linenum, bounds, changedTo)
+		if !more && !replace {
+			break
+		}
+		if !replace {
+			continue
+		}
+
+		if stats.Replacements == 0 {
+			v.printer.Begin(fn, 0)
 		}
+		stats.Replacements++
+		v.printer.Replace(fn, &Replacement{
+			num:    linenum,
+			column: bounds[0] - lineStart(content, bounds[0]) + 1,
+			start:  bounds[0],
+			end:    bounds[1],
+			before: content[bounds[0]:bounds[1]],
+			after:  changedTo,
+		})
 
-		changenum += 1
-		changedTo := v.pattern.ReplaceAll(s, []byte(*opts.Replace))
-		v.printer.Printf("@g  - %s\n", "  - %s\n", string(s))
-		v.printer.Printf("@g  + %s\n", "  + %s\n", string(changedTo))
-		return changedTo
-	})
+		edits = append(edits, &Edit{bounds[0], bounds[1], changedTo})
+	}
 
-	if changenum > 0 {
-		v.printer.Printf("@!@y  %d change%s\n", "  %d change%s\n",
-			changenum, getSuffix(changenum))
+	if len(edits) == 0 {
+		return content, nil
 	}
 
-	return changed, result
+	if opts.Diff || opts.DryRun {
+		context := 3
+		if opts.DiffContext != nil {
+			context = *opts.DiffContext
+		}
+		v.printer.Diff(fn, UnifiedDiff(fn, content, edits, context))
+	}
+	return Apply(content, edits), edits
 }
 
+// LineInfo is a line (or several lines, if match spans them) with all matches
+// found in it
 type LineInfo struct {
-	num  int
-	line []byte
+	num     int
+	line    []byte
+	begin   int
+	end     int
+	content []byte
+	matches [][]int // submatch indexes, relative to content
+	which   []int   // pattern of every match, nil if there is only one
+	offset  int     // position of content in the input, when it's read by parts
+	column  int     // position of content in its first line, if line is cut
 }
 
 func (v *GRVisitor) FindAllIndex(content []byte) (res []*LineInfo) {
@@ -408,12 +726,57 @@ func (v *GRVisitor) FindAllIndex(content []byte) (res []*LineInfo) {
 		return v.singlelineFindAllIndex(content)
 	}
 
+	var prev *LineInfo
 	linenum, last := 1, 0
-	for _, bounds := range v.pattern.FindAllIndex(content, -1) {
-		linenum += bytes.Count(content[last:bounds[0]], byteNewLine)
+	matches, which := v.pattern.FindAll(content)
+	for i, bounds := range matches {
+		// match starts on a line we've already seen
+		if prev != nil && bounds[0] <= prev.end {
+			prev.matches = append(prev.matches, bounds)
+			if which != nil {
+				prev.which = append(prev.which, which[i])
+			}
+			if bounds[1] > prev.end {
+				_, prev.end = beginend(content, bounds[0], bounds[1])
+				prev.line = content[prev.begin:prev.end]
+			}
+			continue
+		}
+
+		linenum += countLines(content[last:bounds[0]])
 		last = bounds[0]
 		begin, end := beginend(content, bounds[0], bounds[1])
-		res = append(res, &LineInfo{linenum, content[begin:end]})
+		prev = &LineInfo{linenum, content[begin:end], begin, end, content,
+			[][]int{bounds}, nil, 0, 0}
+		if which != nil {
+			prev.which = []int{which[i]}
+		}
+		res = append(res, prev)
+	}
+	return res
+}
+
+// Returns lines without matches, for --invert-match
+func (v *GRVisitor) invertFindAllIndex(content []byte) (res []*LineInfo) {
+	found := v.FindAllIndex(content)
+	linenum, begin := 1, 0
+	for begin < len(content) {
+		end := bytes.IndexByte(content[begin:], '\n')
+		if end == -1 {
+			end = len(content)
+		} else {
+			end += begin
+		}
+
+		for len(found) > 0 && found[0].end < begin {
+			found = found[1:]
+		}
+		if len(found) == 0 || begin < found[0].begin {
+			res = append(res, &LineInfo{linenum, content[begin:end], begin, end,
+				content, nil, nil, 0, 0})
+		}
+		linenum++
+		begin = end + 1
 	}
 	return res
 }
@@ -424,8 +787,17 @@ func (v *GRVisitor) singlelineFindAllIndex(content []byte) (res []*LineInfo) {
 		if content[i] == '\n' {
 			end = i
 			line := content[begin:end]
-			if v.pattern.Match(line) {
-				res = append(res, &LineInfo{linenum, line})
+			matches, which := v.pattern.FindAll(line)
+			if matches != nil {
+				for _, m := range matches {
+					for j := range m {
+						if m[j] != -1 {
+							m[j] += begin
+						}
+					}
+				}
+				res = append(res, &LineInfo{linenum, line, begin, end, content,
+					matches, which, 0, 0})
 			}
 			linenum += 1
 			begin = end + 1
@@ -434,6 +806,15 @@ func (v *GRVisitor) singlelineFindAllIndex(content []byte) (res []*LineInfo) {
 	return res
 }
 
+func countLines(s []byte) int {
+	return bytes.Count(s, byteNewLine)
+}
+
+// Returns offset of the beginning of the line, where pos is
+func lineStart(s []byte, pos int) int {
+	return bytes.LastIndexByte(s[:pos], '\n') + 1
+}
+
 // Given a []byte, start and finish of some inner slice, will find nearest
 // newlines on both ends of this slice to contain this slice
 func beginend(s []byte, start int, finish int) (begin int, end int) {
@@ -457,17 +838,3 @@ func beginend(s []byte, start int, finish int) (begin int, end int) {
 
 	return begin, end
 }
-
-type IntSet struct {
-	set map[int]bool
-}
-
-func NewIntSet() *IntSet {
-	return &IntSet{make(map[int]bool)}
-}
-
-func (set *IntSet) Add(i int) bool {
-	_, found := set.set[i]
-	set.set[i] = true
-	return !found // False if it existed already
-}
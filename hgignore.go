@@ -0,0 +1,327 @@
+// (c) 2011-2014 Alexander Solovyov
+// under terms of ISC license
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// a single pattern of .hgignore
+type hgPattern struct {
+	syntax  string
+	pattern string
+	dir     string // patterns from subincludes match only paths inside of it
+	re      *regexp.Regexp
+	fp      string // file it was read from
+	line    int
+}
+
+func (p *hgPattern) String() string {
+	if p.dir != "" {
+		return p.dir + "/" + p.syntax + ":" + p.pattern
+	}
+	return p.syntax + ":" + p.pattern
+}
+
+// Source returns file and line pattern was read from
+func (p *hgPattern) Source() string {
+	return fmt.Sprintf("%s:%d", shortPath(p.fp), p.line)
+}
+
+// Matches path relative to repository root
+func (p *hgPattern) Match(path string) bool {
+	if p.dir != "" {
+		if !strings.HasPrefix(path, p.dir+"/") {
+			return false
+		}
+		path = path[len(p.dir)+1:]
+	}
+	return p.re.MatchString(path)
+}
+
+// syntaxes which can be used in "syntax:" lines and as prefixes of patterns,
+// mapped to the way they are interpreted in ignore files
+var hgSyntaxes = map[string]string{
+	"re":         "relre",
+	"regexp":     "relre",
+	"relre":      "relre",
+	"glob":       "relglob",
+	"relglob":    "relglob",
+	"rootglob":   "rootglob",
+	"path":       "path",
+	"include":    "include",
+	"subinclude": "subinclude",
+}
+
+// Reads hgignore-style file, with root being a repository root and dir being
+// a directory (relative to root) its patterns apply to. Files, which were
+// already read, are skipped to avoid include cycles.
+func readHgPatterns(fp string, root string, dir string, seen map[string]bool) ([]*hgPattern, error) {
+	if seen[fp] {
+		return nil, nil
+	}
+	seen[fp] = true
+
+	f, err := os.Open(fp)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	patterns := []*hgPattern{}
+	reader := bufio.NewReader(f)
+	syntax := "relre"
+	for n := 1; ; n++ {
+		line, _, err := reader.ReadLine()
+		if err != nil {
+			break
+		}
+
+		line = stripHgComment(line)
+		line = bytes.TrimRight(line, " \t")
+		if len(line) == 0 {
+			continue
+		}
+
+		// if it's a syntax changer
+		if bytes.HasPrefix(line, []byte("syntax:")) {
+			s := string(bytes.TrimSpace(line[7:]))
+			if actual, ok := hgSyntaxes[s]; ok {
+				syntax = actual
+			} else {
+				errhandle(fmt.Errorf("%s: ignoring invalid syntax '%s'", fp, s),
+					false)
+			}
+			continue
+		}
+
+		pat := string(line)
+		linesyntax := syntax
+		if colon := strings.IndexByte(pat, ':'); colon != -1 {
+			if actual, ok := hgSyntaxes[pat[:colon]]; ok {
+				linesyntax = actual
+				pat = pat[colon+1:]
+			}
+		}
+
+		if linesyntax == "include" || linesyntax == "subinclude" {
+			inc := expandHome(os.ExpandEnv(pat))
+			if !filepath.IsAbs(inc) {
+				inc = filepath.Join(filepath.Dir(fp), inc)
+			}
+			incdir := dir
+			if linesyntax == "subinclude" {
+				rel, err := filepath.Rel(root, filepath.Dir(inc))
+				if err != nil || rel == ".." || strings.HasPrefix(rel, "../") {
+					errhandle(fmt.Errorf("%s: subinclude outside of repository: %s",
+						fp, pat), false)
+					continue
+				}
+				incdir = filepath.ToSlash(rel)
+				if incdir == "." {
+					incdir = ""
+				}
+			}
+
+			included, err := readHgPatterns(inc, root, incdir, seen)
+			if err != nil {
+				errhandle(fmt.Errorf("%s: skipping unreadable pattern file: %s",
+					fp, err), false)
+			}
+			patterns = append(patterns, included...)
+			continue
+		}
+
+		re, err := regexp.Compile(hgPatternRe(linesyntax, pat))
+		if err != nil {
+			errhandle(fmt.Errorf("can't compile pattern %s\n", pat), false)
+			continue
+		}
+		patterns = append(patterns, &hgPattern{linesyntax, pat, dir, re, fp, n})
+	}
+	return patterns, nil
+}
+
+// "#" starts a comment, unless it's escaped with a backslash
+func stripHgComment(line []byte) []byte {
+	if bytes.IndexByte(line, '#') == -1 {
+		return line
+	}
+
+	var res bytes.Buffer
+	for i := 0; i < len(line); i++ {
+		switch {
+		case line[i] == '\\' && i+1 < len(line) && line[i+1] == '#':
+			res.WriteByte('#')
+			i++
+		case line[i] == '#':
+			return res.Bytes()
+		default:
+			res.WriteByte(line[i])
+		}
+	}
+	return res.Bytes()
+}
+
+// Converts pattern to regular expression, which is matched against path
+// relative to repository root; like in Mercurial, patterns also match
+// everything inside matched directories.
+func hgPatternRe(syntax string, pat string) string {
+	switch syntax {
+	case "relglob":
+		return "^(?:.*/)?" + hgGlobRe(pat) + "(?:/|$)"
+	case "rootglob":
+		return "^" + hgGlobRe(pat) + "(?:/|$)"
+	case "path":
+		pat = strings.Trim(filepath.ToSlash(filepath.Clean(pat)), "/")
+		if pat == "." || pat == "" {
+			return ""
+		}
+		return "^" + regexp.QuoteMeta(pat) + "(?:/|$)"
+	}
+	return pat
+}
+
+// Port of Mercurial's glob translation: "*" matches anything except "/",
+// "**" matches anything and "{a,b}" matches either of alternatives
+func hgGlobRe(s string) string {
+	var pat bytes.Buffer
+	group := 0
+	n := len(s)
+
+	for i := 0; i < n; {
+		c := s[i]
+		i++
+
+		switch {
+		case c == '*':
+			if i < n && s[i] == '*' {
+				i++
+				if i < n && s[i] == '/' {
+					i++
+					pat.WriteString("(?:.*/)?")
+				} else {
+					pat.WriteString(".*")
+				}
+			} else {
+				pat.WriteString("[^/]*")
+			}
+		case c == '?':
+			pat.WriteByte('.')
+		case c == '[':
+			j := i
+			if j < n && (s[j] == '!' || s[j] == ']') {
+				j++
+			}
+			for j < n && s[j] != ']' {
+				j++
+			}
+
+			if j >= n {
+				pat.WriteString("\\[")
+			} else {
+				stuff := strings.Replace(s[i:j], "\\", "\\\\", -1)
+				i = j + 1
+				if stuff[0] == '!' {
+					stuff = "^" + stuff[1:]
+				} else if stuff[0] == '^' {
+					stuff = "\\" + stuff
+				}
+				pat.WriteString("[" + stuff + "]")
+			}
+		case c == '{':
+			group++
+			pat.WriteString("(?:")
+		case c == '}' && group > 0:
+			group--
+			pat.WriteString(")")
+		case c == ',' && group > 0:
+			pat.WriteString("|")
+		case c == '\\' && i < n:
+			pat.WriteString(regexp.QuoteMeta(string(s[i])))
+			i++
+		default:
+			pat.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	return pat.String()
+}
+
+// Returns ignore files configured with "ignore" and "ignore.*" keys of [ui]
+// section in user's and repository's hgrc, relative to repository root
+func hgIgnoreFiles(root string) []string {
+	var configs []string
+	if home, err := os.UserHomeDir(); err == nil {
+		configs = append(configs, filepath.Join(home, ".hgrc"))
+	}
+	configs = append(configs, filepath.Join(root, ".hg", "hgrc"))
+
+	values := map[string]string{}
+	for _, fp := range configs {
+		readHgrcIgnores(fp, values)
+	}
+
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	files := []string{}
+	for _, name := range names {
+		path := expandHome(os.ExpandEnv(values[name]))
+		if path == "" {
+			continue
+		}
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(root, path)
+		}
+		files = append(files, path)
+	}
+	return files
+}
+
+func readHgrcIgnores(fp string, values map[string]string) {
+	f, err := os.Open(fp)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	section := ""
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || line[0] == '#' || line[0] == ';' {
+			continue
+		}
+
+		if line[0] == '[' {
+			if end := strings.IndexByte(line, ']'); end != -1 {
+				section = strings.TrimSpace(line[1:end])
+			}
+			continue
+		}
+
+		if section != "ui" {
+			continue
+		}
+
+		eq := strings.IndexByte(line, '=')
+		if eq == -1 {
+			continue
+		}
+		name := strings.TrimSpace(line[:eq])
+		if name == "ignore" || strings.HasPrefix(name, "ignore.") {
+			values[name] = strings.TrimSpace(line[eq+1:])
+		}
+	}
+}
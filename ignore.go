@@ -0,0 +1,291 @@
+// (c) 2011-2014 Alexander Solovyov
+// under terms of ISC license
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// a single line of .gitignore
+type gitPattern struct {
+	glob     string // without negation and escapes
+	negate   bool
+	dirOnly  bool
+	anchored bool   // matches whole path instead of basename
+	pattern  string // wildmatch pattern
+	fp       string // file it was read from
+	line     int
+	casefold bool
+}
+
+// Parses a line of .gitignore, returns nil if it's empty or a comment
+func parseGitPattern(line string) *gitPattern {
+	// trailing spaces are ignored unless escaped with a backslash
+	trimmed := strings.TrimRight(line, " \t")
+	if len(trimmed) < len(line) && strings.HasSuffix(trimmed, "\\") {
+		trimmed = trimmed[:len(trimmed)-1] + " "
+	}
+	line = trimmed
+
+	if len(line) == 0 || line[0] == '#' {
+		return nil
+	}
+
+	negate := false
+	switch {
+	case line[0] == '!':
+		negate = true
+		line = line[1:]
+	case strings.HasPrefix(line, "\\!"), strings.HasPrefix(line, "\\#"):
+		line = line[1:]
+	}
+
+	// patterns with trailing slash match only directories
+	glob := line
+	dirOnly := strings.HasSuffix(line, "/")
+	line = strings.TrimRight(line, "/")
+
+	if len(line) == 0 {
+		return nil
+	}
+
+	// patterns with a slash at the beginning or in the middle are relative to
+	// the directory of ignore file, others match basename at any level
+	anchored := strings.Contains(line, "/")
+	line = strings.TrimPrefix(line, "/")
+	return &gitPattern{glob, negate, dirOnly, anchored, line, "", 0, false}
+}
+
+func (p *gitPattern) String() string {
+	if p.negate {
+		return "!" + p.glob
+	}
+	return p.glob
+}
+
+// Source returns file and line pattern was read from
+func (p *gitPattern) Source() string {
+	return fmt.Sprintf("%s:%d", shortPath(p.fp), p.line)
+}
+
+// Matches path relative to the directory of ignore file
+func (p *gitPattern) Match(path string, isdir bool) bool {
+	if p.dirOnly && !isdir {
+		return false
+	}
+	if !p.anchored {
+		path = path[strings.LastIndex(path, "/")+1:]
+	}
+	return Wildmatch(p.pattern, path, p.casefold)
+}
+
+// Reads gitignore-style file, returns nil if there is no such file
+func readGitPatterns(fp string) []*gitPattern {
+	f, err := os.Open(fp)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+
+	patterns := []*gitPattern{}
+	reader := bufio.NewReader(f)
+	for n := 1; ; n++ {
+		line, _, err := reader.ReadLine()
+		if err != nil {
+			break
+		}
+
+		if pat := parseGitPattern(string(line)); pat != nil {
+			pat.fp, pat.line = fp, n
+			patterns = append(patterns, pat)
+		}
+	}
+	return patterns
+}
+
+// patterns of a single gitignore-style file, relative to its directory
+type ignoreFile struct {
+	fp       string
+	patterns []*gitPattern
+}
+
+// last matching pattern wins, so that negated patterns can re-include what
+// was excluded by previous patterns
+func (f *ignoreFile) match(rel string, isdir bool) *gitPattern {
+	for j := len(f.patterns) - 1; j >= 0; j-- {
+		if f.patterns[j].Match(rel, isdir) {
+			return f.patterns[j]
+		}
+	}
+	return nil
+}
+
+// IgnoreTree reads gitignore-style files with given names from every
+// directory under base path, when they are first needed. Patterns from
+// deeper directories take precedence over ones from their parents, and
+// every file's patterns are relative to its own directory.
+//
+// Additional files with patterns relative to base path (like git's
+// info/exclude) can be added, they have lower precedence than any file in the
+// tree.
+type IgnoreTree struct {
+	basepath string
+	names    []string
+	extra    []*ignoreFile
+	lock     sync.Mutex
+	files    map[string][]*ignoreFile // by directory
+	dirs     map[string]bool          // cache of decisions about directories
+}
+
+func NewIgnoreTree(basepath string, names ...string) *IgnoreTree {
+	return &IgnoreTree{basepath, names, nil, sync.Mutex{},
+		make(map[string][]*ignoreFile), make(map[string]bool)}
+}
+
+// AddFile adds file with patterns relative to base path, files added later
+// take precedence over earlier ones. Returns false if file can't be read.
+func (t *IgnoreTree) AddFile(fp string) bool {
+	patterns := readGitPatterns(fp)
+	if patterns == nil {
+		return false
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.extra = append(t.extra, &ignoreFile{fp, patterns})
+	return true
+}
+
+// load returns ignore files of a directory, reading them if needed
+func (t *IgnoreTree) load(dir string) []*ignoreFile {
+	files, ok := t.files[dir]
+	if ok {
+		return files
+	}
+
+	for _, name := range t.names {
+		fp := filepath.Join(t.basepath, filepath.FromSlash(dir), name)
+		if patterns := readGitPatterns(fp); patterns != nil {
+			files = append(files, &ignoreFile{fp, patterns})
+		}
+	}
+	t.files[dir] = files
+	return files
+}
+
+// Patterns returns patterns from files in directory dir
+func (t *IgnoreTree) Patterns(dir string) []*gitPattern {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	var patterns []*gitPattern
+	for _, f := range t.load(dir) {
+		patterns = append(patterns, f.patterns...)
+	}
+	return patterns
+}
+
+// Ignored reports if rel (slash-separated path relative to base path) is
+// ignored
+func (t *IgnoreTree) Ignored(rel string, isdir bool) bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	// it's not possible to re-include a file if its parent directory is
+	// excluded
+	if t.parentExcluded(rel) {
+		return true
+	}
+
+	if !isdir {
+		pat := t.match(rel, false)
+		return pat != nil && !pat.negate
+	}
+
+	ignored, ok := t.dirs[rel]
+	if !ok {
+		pat := t.match(rel, true)
+		ignored = pat != nil && !pat.negate
+		t.dirs[rel] = ignored
+	}
+	return ignored
+}
+
+// Explain returns pattern, which decides if rel is ignored, and rel's parent
+// directory if pattern excludes it (and so everything inside of it)
+func (t *IgnoreTree) Explain(rel string, isdir bool) (pat *gitPattern, parent string) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	// from the top, since contents of excluded directory can't be re-included
+	var parents []string
+	for dir := parentDir(rel); dir != ""; dir = parentDir(dir) {
+		parents = append(parents, dir)
+	}
+	for j := len(parents) - 1; j >= 0; j-- {
+		if pat := t.match(parents[j], true); pat != nil && !pat.negate {
+			return pat, parents[j]
+		}
+	}
+
+	return t.match(rel, isdir), ""
+}
+
+func (t *IgnoreTree) parentExcluded(rel string) bool {
+	dir := parentDir(rel)
+	if dir == "" {
+		return false
+	}
+
+	ignored, ok := t.dirs[dir]
+	if !ok {
+		ignored = t.parentExcluded(dir)
+		if !ignored {
+			pat := t.match(dir, true)
+			ignored = pat != nil && !pat.negate
+		}
+		t.dirs[dir] = ignored
+	}
+	return ignored
+}
+
+// match finds pattern, which decides if rel is ignored
+func (t *IgnoreTree) match(rel string, isdir bool) *gitPattern {
+	dir := rel
+	for dir != "" {
+		dir = parentDir(dir)
+		sub := rel
+		if dir != "" {
+			sub = rel[len(dir)+1:]
+		}
+
+		files := t.load(dir)
+		for j := len(files) - 1; j >= 0; j-- {
+			if pat := files[j].match(sub, isdir); pat != nil {
+				return pat
+			}
+		}
+	}
+
+	for j := len(t.extra) - 1; j >= 0; j-- {
+		if pat := t.extra[j].match(rel, isdir); pat != nil {
+			return pat
+		}
+	}
+	return nil
+}
+
+// slash-separated analogue of filepath.Dir, returns "" for top level paths
+func parentDir(path string) string {
+	idx := strings.LastIndexByte(path, '/')
+	if idx == -1 {
+		return ""
+	}
+	return path[:idx]
+}
@@ -0,0 +1,167 @@
+// (c) 2011-2014 Alexander Solovyov
+// under terms of ISC license
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"os"
+	"runtime"
+	"strings"
+	"sync/atomic"
+)
+
+// Answers to "Replace?" question
+const (
+	AnswerYes  = 'y' // replace this match
+	AnswerNo   = 'n' // skip this match
+	AnswerAll  = 'a' // replace this and all remaining matches in file
+	AnswerDone = 'd' // skip this and all remaining matches in file
+	AnswerQuit = 'q' // skip everything else
+)
+
+const promptHelp = `y - replace this match
+n - skip this match
+a - replace this and all remaining matches in the file
+d - skip this and all remaining matches in the file
+q - quit, skipping all remaining matches
+`
+
+// Prompter asks user about every replacement. It talks to controlling
+// terminal rather than stdin/stdout, so it works in pipelines too.
+type Prompter struct {
+	in      *bufio.Reader
+	printer *TextPrinter
+	context int
+	quit    int32
+}
+
+func openTerminal() (in io.Reader, out io.Writer, err error) {
+	if runtime.GOOS == "windows" {
+		fin, err := os.Open("CONIN$")
+		if err != nil {
+			return nil, nil, err
+		}
+		fout, err := os.OpenFile("CONOUT$", os.O_WRONLY, 0)
+		return fin, fout, err
+	}
+
+	f, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+	return f, f, err
+}
+
+func NewPrompter(context int) (*Prompter, error) {
+	in, out, err := openTerminal()
+	if err != nil {
+		return nil, err
+	}
+	return newPrompter(in, out, context), nil
+}
+
+func newPrompter(in io.Reader, out io.Writer, context int) *Prompter {
+	printer := &TextPrinter{NoColors: NoColors, out: out}
+	return &Prompter{bufio.NewReader(in), printer, context, 0}
+}
+
+// Quit reports if user asked to stop
+func (p *Prompter) Quit() bool {
+	return atomic.LoadInt32(&p.quit) != 0
+}
+
+// Ask shows match at bounds (on line num) with some context and what it's
+// going to be replaced with, and returns user's decision
+func (p *Prompter) Ask(fn string, content []byte, num int, bounds []int,
+	changedTo []byte) byte {
+
+	begin, end := beginend(content, bounds[0], bounds[1])
+	first, start := num, begin
+	for ; first > num-p.context && start > 0; first-- {
+		start = lineStart(content, start-1)
+	}
+
+	p.printer.Printf("\n@g%s@|:@y%d\n", "\n%s:%d\n", fn, num)
+	for i, line := range bytes.Split(content[start:begin], byteNewLine) {
+		if first+i < num {
+			p.printer.Printf("@y%6d@|  %s\n", "%6d  %s\n", first+i, line)
+		}
+	}
+
+	for i, line := range bytes.Split(content[begin:end], byteNewLine) {
+		p.printer.Printf("@r%6d- %s\n", "%6d- %s\n", num+i, line)
+	}
+	replaced := append(append(append([]byte{}, content[begin:bounds[0]]...),
+		changedTo...), content[bounds[1]:end]...)
+	for _, line := range bytes.Split(replaced, byteNewLine) {
+		p.printer.Printf("@g      + %s\n", "      + %s\n", line)
+	}
+
+	after := end
+	for i := 1; i <= p.context && after < len(content)-1; i++ {
+		next := bytes.IndexByte(content[after+1:], '\n')
+		if next == -1 {
+			next = len(content)
+		} else {
+			next += after + 1
+		}
+		p.printer.Printf("@y%6d@|  %s\n", "%6d  %s\n",
+			num+countLines(content[begin:end])+i, content[after+1:next])
+		after = next
+	}
+
+	for {
+		p.printer.Printf("@!Replace? [y,n,a,d,q,?] ", "Replace? [y,n,a,d,q,?] ")
+		line, err := p.in.ReadString('\n')
+		if err != nil && line == "" {
+			atomic.StoreInt32(&p.quit, 1)
+			return AnswerQuit
+		}
+
+		answer := strings.ToLower(strings.TrimSpace(line))
+		if len(answer) == 1 && strings.IndexByte("ynadq", answer[0]) != -1 {
+			if answer[0] == AnswerQuit {
+				atomic.StoreInt32(&p.quit, 1)
+			}
+			return answer[0]
+		}
+		p.printer.Printf(promptHelp, promptHelp)
+	}
+}
+
+// Confirmer tracks answers for matches in a single file
+type Confirmer struct {
+	prompter *Prompter
+	fn       string
+	decided  byte
+}
+
+func (p *Prompter) ForFile(fn string) *Confirmer {
+	return &Confirmer{p, fn, 0}
+}
+
+// Confirm returns if match should be replaced and if there is any point in
+// asking about further matches in this file
+func (c *Confirmer) Confirm(content []byte, num int, bounds []int,
+	changedTo []byte) (replace bool, more bool) {
+
+	if c == nil || c.decided == AnswerAll {
+		return true, true
+	}
+	if c.decided != 0 || c.prompter.Quit() {
+		return false, false
+	}
+
+	switch c.prompter.Ask(c.fn, content, num, bounds, changedTo) {
+	case AnswerYes:
+		return true, true
+	case AnswerNo:
+		return false, true
+	case AnswerAll:
+		c.decided = AnswerAll
+		return true, true
+	default:
+		c.decided = AnswerDone
+		return false, false
+	}
+}
@@ -0,0 +1,110 @@
+// (c) 2011-2014 Alexander Solovyov
+// under terms of ISC license
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// runs interactive replacement of "foo" with "bar" in files with given
+// contents, answering with answers, and returns resulting contents and
+// everything prompter has printed
+func runInteractive(t *testing.T, contents []string, answers string) ([]string, string) {
+	dir, err := ioutil.TempDir("", "gr-interactive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	saved, savedColors := opts, NoColors
+	defer func() { opts, NoColors = saved, savedColors }()
+	NoColors = true
+	opts.Replace = []string{"bar"}
+	opts.Links = LinksFollow
+	opts.Jobs = 4
+
+	pattern, err := NewPattern([]string{"foo"}, opts.Replace)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var paths []string
+	for i, content := range contents {
+		fn := filepath.Join(dir, string('a'+rune(i)))
+		if err := ioutil.WriteFile(fn, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		paths = append(paths, fn)
+	}
+
+	var asked, out bytes.Buffer
+	printer := &TextPrinter{NoColors: true, out: &out}
+	v := &GRVisitor{printer, pattern, nil, nil, nil, nil}
+	v.prompter = newPrompter(strings.NewReader(answers), &asked, 0)
+	if jobs := v.jobs(); jobs != 1 {
+		t.Fatalf("got %d jobs, questions should be asked one by one", jobs)
+	}
+
+	roots := NewSearchRoots(paths, nil, map[string]bool{})
+	if _, err := v.Run(roots, v.jobs(), true, &out, false); err != nil {
+		t.Fatal(err)
+	}
+
+	var results []string
+	for _, fn := range paths {
+		content, err := ioutil.ReadFile(fn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		results = append(results, string(content))
+	}
+	return results, asked.String()
+}
+
+func TestPrompterAnswers(t *testing.T) {
+	contents := []string{
+		"foo\nfoo\n", // y, n
+		"foo\nfoo\n", // a
+		"foo\nfoo\n", // d
+		"foo\nfoo\n", // ?, y, q
+		"foo\nfoo\n", // not asked
+	}
+	results, asked := runInteractive(t, contents, "y\nn\na\nd\n?\nY\nq\n")
+
+	expected := []string{
+		"bar\nfoo\n",
+		"bar\nbar\n",
+		"foo\nfoo\n",
+		"bar\nfoo\n",
+		"foo\nfoo\n",
+	}
+	for i := range expected {
+		if results[i] != expected[i] {
+			t.Errorf("file %d: got %q, expected %q", i, results[i], expected[i])
+		}
+	}
+
+	if n := strings.Count(asked, "Replace? "); n != 7 {
+		t.Errorf("asked %d times, expected 7:\n%s", n, asked)
+	}
+	if n := strings.Count(asked, promptHelp); n != 1 {
+		t.Errorf("help printed %d times, expected once:\n%s", n, asked)
+	}
+	if !strings.Contains(asked, "     1- foo\n      + bar\n") {
+		t.Errorf("replacement is not shown:\n%s", asked)
+	}
+}
+
+func TestPrompterEOF(t *testing.T) {
+	// no more answers means quit
+	results, _ := runInteractive(t, []string{"foo\nfoo\n", "foo\n"}, "y\n")
+	if results[0] != "bar\nfoo\n" || results[1] != "foo\n" {
+		t.Errorf("got %q", results)
+	}
+}
@@ -0,0 +1,203 @@
+// (c) 2011-2014 Alexander Solovyov
+// under terms of ISC license
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Journal records every file changed during a run, so the run can be undone
+// with --undo. It's a JSON Lines file with a header and an entry for every
+// file, written before the file itself, so even runs which were interrupted
+// can be undone.
+type Journal struct {
+	path   string
+	header *journalHeader
+	f      *os.File
+	lock   sync.Mutex
+}
+
+type journalHeader struct {
+	Time    time.Time `json:"time"`
+	Dir     string    `json:"dir"`
+	Pattern string    `json:"pattern"`
+	Replace string    `json:"replace"`
+}
+
+type journalEntry struct {
+	Path     string              `json:"path"`
+	Original string              `json:"original"`
+	Result   string              `json:"result"`
+	Edits    []*journalEntryEdit `json:"edits"`
+}
+
+// edit, positioned in the original content
+type journalEntryEdit struct {
+	Start  int    `json:"start"`
+	Before []byte `json:"before"`
+	After  []byte `json:"after"`
+}
+
+func JournalPath() (string, error) {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "gr", "journal.jsonl"), nil
+}
+
+func hash(content []byte) string {
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:])
+}
+
+func NewJournal(pattern, replace string) (*Journal, error) {
+	path, err := JournalPath()
+	if err != nil {
+		return nil, err
+	}
+
+	wd, _ := os.Getwd()
+	header := &journalHeader{time.Now(), wd, pattern, replace}
+	return &Journal{path: path, header: header}, nil
+}
+
+// start truncates journal of the previous run, it's called on first change,
+// so runs which changed nothing keep the previous journal
+func (j *Journal) start() error {
+	if err := os.MkdirAll(filepath.Dir(j.path), 0700); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(j.path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	j.f = f
+	return j.write(j.header)
+}
+
+func (j *Journal) write(v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if _, err := j.f.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	return j.f.Sync()
+}
+
+// Record should be called before fn is changed from content to result
+func (j *Journal) Record(fn string, content, result []byte, edits []*Edit) error {
+	path, err := filepath.Abs(fn)
+	if err != nil {
+		return err
+	}
+
+	entry := &journalEntry{path, hash(content), hash(result), nil}
+	for _, e := range edits {
+		entry.Edits = append(entry.Edits,
+			&journalEntryEdit{e.Start, content[e.Start:e.End], e.Text})
+	}
+
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	if j.f == nil {
+		if err := j.start(); err != nil {
+			return err
+		}
+	}
+	return j.write(entry)
+}
+
+func (j *Journal) Close() error {
+	if j.f == nil {
+		return nil
+	}
+	return j.f.Close()
+}
+
+// Undo restores files changed by the last run, skipping files which were
+// changed since then
+func Undo(printer Printer) error {
+	path, err := JournalPath()
+	if err != nil {
+		return err
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return fmt.Errorf("Nothing to undo")
+	}
+	if err != nil {
+		return err
+	}
+
+	lines := splitLines(data)
+	if len(lines) < 2 {
+		return fmt.Errorf("Nothing to undo")
+	}
+
+	// entries which can't be undone are kept for another try
+	kept := lines[:1]
+	for _, line := range lines[1:] {
+		var entry journalEntry
+		if err := json.Unmarshal(line, &entry); err != nil {
+			return fmt.Errorf("Can't read journal %s: %s", path, err)
+		}
+		if err := undoEntry(&entry); err != nil {
+			errhandle(fmt.Errorf("Not restoring %s: %s", entry.Path, err), false)
+			kept = append(kept, line)
+			continue
+		}
+		printer.Notice("@gRestored %s\n", "Restored %s\n", entry.Path)
+	}
+
+	if len(kept) == 1 {
+		return os.Remove(path)
+	}
+	if err := WriteFile(path, bytes.Join(kept, nil), LinksFollow); err != nil {
+		return err
+	}
+	return fmt.Errorf("Some files were not restored")
+}
+
+func undoEntry(entry *journalEntry) error {
+	content, err := ioutil.ReadFile(entry.Path)
+	if err != nil {
+		return err
+	}
+	if hash(content) != entry.Result {
+		return fmt.Errorf("file was changed since replacement")
+	}
+
+	// positions of edits in current content are shifted by previous edits
+	edits := make([]*Edit, len(entry.Edits))
+	shift := 0
+	for i, e := range entry.Edits {
+		start := e.Start + shift
+		if start+len(e.After) > len(content) {
+			return fmt.Errorf("journal does not match file")
+		}
+		edits[i] = &Edit{start, start + len(e.After), e.Before}
+		shift += len(e.After) - len(e.Before)
+	}
+
+	original := Apply(content, edits)
+	if hash(original) != entry.Original {
+		return fmt.Errorf("journal does not match file")
+	}
+	return WriteFile(entry.Path, original, LinksFollow)
+}
@@ -0,0 +1,211 @@
+// (c) 2011-2014 Alexander Solovyov
+// under terms of ISC license
+
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+// JSONPrinter writes one JSON object per line for every event, so that gr's
+// output can be consumed by other programs
+type JSONPrinter struct {
+	out    io.Writer
+	enc    *json.Encoder
+	begun  bool
+	totals *jsonTotals
+}
+
+// totals are shared between all forks of a printer
+type jsonTotals struct {
+	start        time.Time
+	files        int64
+	filesMatched int64
+	matches      int64
+	replacements int64
+}
+
+type jsonSubmatch struct {
+	Start int    `json:"start"`
+	End   int    `json:"end"`
+	Text  string `json:"text"`
+}
+
+type jsonEvent struct {
+	Type         string          `json:"type"`
+	Path         string          `json:"path,omitempty"`
+	Line         int             `json:"line,omitempty"`
+	Column       int             `json:"column,omitempty"`
+	Start        *int            `json:"start,omitempty"`
+	End          *int            `json:"end,omitempty"`
+	Text         *string         `json:"text,omitempty"`
+	LineText     *string         `json:"line_text,omitempty"`
+	Submatches   []*jsonSubmatch `json:"submatches,omitempty"`
+	Pattern      *int            `json:"pattern,omitempty"`
+	Before       *string         `json:"before,omitempty"`
+	After        *string         `json:"after,omitempty"`
+	Diff         *string         `json:"diff,omitempty"`
+	Matches      *int64          `json:"matches,omitempty"`
+	Replacements *int64          `json:"replacements,omitempty"`
+	Files        *int64          `json:"files,omitempty"`
+	FilesMatched *int64          `json:"files_matched,omitempty"`
+	Elapsed      *float64        `json:"elapsed,omitempty"`
+}
+
+func NewJSONPrinter(out io.Writer) *JSONPrinter {
+	return &JSONPrinter{out, json.NewEncoder(out), false,
+		&jsonTotals{start: time.Now()}}
+}
+
+func (p *JSONPrinter) emit(ev *jsonEvent) {
+	err := p.enc.Encode(ev)
+	errhandle(err, false)
+}
+
+func (p *JSONPrinter) begin(fn string) {
+	if !p.begun {
+		p.begun = true
+		p.emit(&jsonEvent{Type: "begin", Path: fn})
+	}
+}
+
+func (p *JSONPrinter) Fork(out io.Writer) Printer {
+	return &JSONPrinter{out, json.NewEncoder(out), false, p.totals}
+}
+
+func (p *JSONPrinter) Grouped() bool {
+	return false
+}
+
+func (p *JSONPrinter) Notice(colorfmt, plainfmt string, args ...interface{}) {
+}
+
+func (p *JSONPrinter) Begin(fn string, maxLine int) {
+	p.begin(fn)
+}
+
+func (p *JSONPrinter) Match(fn string, info *LineInfo) {
+	p.begin(fn)
+	lineText := string(info.line)
+
+	// lines without matches are printed for --invert-match
+	if len(info.matches) == 0 {
+		p.emit(&jsonEvent{Type: "match", Path: fn, Line: info.num,
+			LineText: &lineText})
+		return
+	}
+
+	for i, m := range info.matches {
+		start, end := m[0], m[1]
+		text := string(info.content[start:end])
+		column := info.column + start - lineStart(info.content, start) + 1
+		line := info.num + countLines(info.content[info.begin:start])
+
+		var submatches []*jsonSubmatch
+		for i := 2; i+1 < len(m); i += 2 {
+			if m[i] == -1 {
+				submatches = append(submatches, nil)
+				continue
+			}
+			submatches = append(submatches, &jsonSubmatch{
+				info.offset + m[i], info.offset + m[i+1],
+				string(info.content[m[i]:m[i+1]])})
+		}
+
+		start, end = info.offset+start, info.offset+end
+
+		// index of pattern, only if there are several of them
+		var pattern *int
+		if info.which != nil {
+			pattern = &info.which[i]
+		}
+
+		p.emit(&jsonEvent{
+			Type:       "match",
+			Path:       fn,
+			Line:       line,
+			Column:     column,
+			Start:      &start,
+			End:        &end,
+			Text:       &text,
+			LineText:   &lineText,
+			Submatches: submatches,
+			Pattern:    pattern,
+		})
+	}
+}
+
+func (p *JSONPrinter) Context(fn string, num int, line []byte) {
+	p.begin(fn)
+	text := string(line)
+	p.emit(&jsonEvent{Type: "context", Path: fn, Line: num, LineText: &text})
+}
+
+func (p *JSONPrinter) Break(fn string) {
+}
+
+func (p *JSONPrinter) BinaryMatch(fn string) {
+	p.begin(fn)
+	p.emit(&jsonEvent{Type: "binary", Path: fn})
+}
+
+func (p *JSONPrinter) FileName(fn string) {
+	p.emit(&jsonEvent{Type: "file", Path: fn})
+}
+
+func (p *JSONPrinter) FoundName(fn string, matches [][]int) {
+	p.emit(&jsonEvent{Type: "file", Path: fn})
+}
+
+func (p *JSONPrinter) Replace(fn string, r *Replacement) {
+	p.begin(fn)
+	before, after := string(r.before), string(r.after)
+	p.emit(&jsonEvent{
+		Type:   "replace",
+		Path:   fn,
+		Line:   r.num,
+		Column: r.column,
+		Start:  &r.start,
+		End:    &r.end,
+		Before: &before,
+		After:  &after,
+	})
+}
+
+func (p *JSONPrinter) Diff(fn string, diff []byte) {
+	p.begin(fn)
+	text := string(diff)
+	p.emit(&jsonEvent{Type: "diff", Path: fn, Diff: &text})
+}
+
+func (p *JSONPrinter) End(fn string, stats *FileStats) {
+	atomic.AddInt64(&p.totals.files, 1)
+	atomic.AddInt64(&p.totals.matches, int64(stats.Matches))
+	atomic.AddInt64(&p.totals.replacements, int64(stats.Replacements))
+	if stats.Matches > 0 || stats.Replacements > 0 {
+		atomic.AddInt64(&p.totals.filesMatched, 1)
+	}
+
+	if !p.begun {
+		return
+	}
+	matches := int64(stats.Matches)
+	replacements := int64(stats.Replacements)
+	p.emit(&jsonEvent{Type: "end", Path: fn, Matches: &matches,
+		Replacements: &replacements})
+}
+
+func (p *JSONPrinter) Summary() {
+	elapsed := time.Since(p.totals.start).Seconds()
+	p.emit(&jsonEvent{
+		Type:         "summary",
+		Files:        &p.totals.files,
+		FilesMatched: &p.totals.filesMatched,
+		Matches:      &p.totals.matches,
+		Replacements: &p.totals.replacements,
+		Elapsed:      &elapsed,
+	})
+}
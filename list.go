@@ -0,0 +1,67 @@
+// (c) 2011-2014 Alexander Solovyov
+// under terms of ISC license
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+func listFiles(roots []*searchRoot) {
+	v := &GRVisitor{nil, nil, nil, nil, nil, nil}
+	if opts.Backup != "" || opts.BackupDir != "" {
+		v.backuper = NewBackuper(opts.Backup, opts.BackupDir, opts.BackupOverwrite)
+	}
+
+	for _, root := range roots {
+		if root.path == stdinPath {
+			continue
+		}
+		rv := *v
+		rv.ignoreFileMatcher = root.matcher
+		err := rv.List(root, opts.ListIgnored, os.Stdout)
+		errhandle(err, false)
+	}
+}
+
+// List walks root with the same rules as Run, but doesn't read files: it
+// prints either files, which would be searched, or skipped files and
+// directories with reasons
+func (v *GRVisitor) List(root *searchRoot, ignored bool, out io.Writer) error {
+	return root.Walk(func(fn string, fi os.FileInfo, err error) error {
+		if err != nil {
+			if opts.Verbose {
+				errhandle(err, false)
+			}
+			return nil
+		}
+
+		reason := v.SkipReason(fn, fi)
+		switch {
+		case reason == "" && !ignored && !fi.IsDir():
+			printListed(out, fn, "")
+		case reason != "" && ignored:
+			printListed(out, fn, reason)
+		}
+
+		if reason != "" && fi.IsDir() {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+}
+
+// NUL-separated output is meant for xargs, so reasons are omitted there
+func printListed(out io.Writer, fn string, reason string) {
+	switch {
+	case opts.Null:
+		fmt.Fprintf(out, "%s\x00", fn)
+	case reason != "":
+		fmt.Fprintf(out, "%s\t%s\n", fn, reason)
+	default:
+		fmt.Fprintf(out, "%s\n", fn)
+	}
+}
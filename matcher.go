@@ -4,8 +4,6 @@
 package main
 
 import (
-	"bufio"
-	"bytes"
 	"fmt"
 	"os"
 	"path/filepath"
@@ -15,7 +13,9 @@ import (
 
 type Matcher interface {
 	Match(fn string, isdir bool) bool
-	Append(pats []string)
+	// Explain tells if fn is ignored and why, reason is empty if nothing in
+	// matcher is related to fn
+	Explain(fn string, isdir bool) (ignored bool, reason string)
 }
 
 func dirExists(path string) bool {
@@ -26,29 +26,165 @@ func dirExists(path string) bool {
 	return fi.IsDir()
 }
 
-func NewMatcher(wd string, noIgnores bool) Matcher {
-	path := wd
-	if !filepath.IsAbs(path) {
-		panic("Given path should be absolute")
+// Layers of MatcherStack, in order of evaluation
+var matcherLayers = []string{"general", "vcs", "project", "exclude", "only",
+	"glob", "type"}
+
+type matcherLayer struct {
+	name     string
+	matcher  Matcher // nil if layer is disabled or not applicable
+	disabled bool
+}
+
+// MatcherStack ignores a file if any of its enabled layers does:
+//
+//   - general: common files and directories (like .svn or *.pyc)
+//   - vcs: .gitignore or .hgignore of repository
+//   - project: .ignore and .grignore files
+//   - exclude: regular expressions from -x
+//   - only: regular expressions from -o, ignores files matching none of them
+//   - glob: globs from -g, relative to root
+//   - type: file types from -t and -T
+//
+// Paths are given as printed, relative to current directory, and are made
+// relative to root for layers, which need that (-x and -o match paths as they
+// are printed, and types need to read files).
+type MatcherStack struct {
+	root   string
+	layers []*matcherLayer
+}
+
+func NewMatcherStack(root string, disabled map[string]bool,
+	excludes []string, only []string, globs Matcher, types Matcher) *MatcherStack {
+
+	wd, err := filepath.Abs(root)
+	errhandle(err, true)
+
+	var vcs Matcher
+	basepath := wd
+	if !disabled["vcs"] || !disabled["project"] {
+		vcs, basepath = NewVCSMatcher(wd)
 	}
+	stack := &MatcherStack{root: root}
+	for _, name := range matcherLayers {
+		layer := &matcherLayer{name, nil, disabled[name]}
+		stack.layers = append(stack.layers, layer)
+		if layer.disabled {
+			continue
+		}
 
-	for !noIgnores {
-		if filepath.Dir(path) == path { // top directory
-			break
+		switch name {
+		case "general":
+			layer.matcher = NewGeneralMatcher(generalDirs, generalPats)
+		case "vcs":
+			if vcs != nil {
+				layer.matcher = vcs
+			}
+		case "project":
+			if vcs == nil {
+				basepath = findProjectRoot(wd)
+			}
+			layer.matcher = NewProjectMatcher(wd, basepath)
+		case "exclude":
+			layer.matcher = NewRegexpMatcher(excludes, false)
+		case "only":
+			layer.matcher = NewRegexpMatcher(only, true)
+		case "glob":
+			layer.matcher = globs
+		case "type":
+			layer.matcher = types
+		}
+	}
+	return stack
+}
+
+// Checks that names are known layers
+func checkLayers(names []string) error {
+	for _, name := range names {
+		known := false
+		for _, layer := range matcherLayers {
+			known = known || layer == name
+		}
+		if !known {
+			return fmt.Errorf("unknown layer '%s', should be one of: %s", name,
+				strings.Join(matcherLayers, ", "))
+		}
+	}
+	return nil
+}
+
+func (s *MatcherStack) Match(fn string, isdir bool) bool {
+	rel := s.rel(fn)
+	for _, layer := range s.layers {
+		if layer.matcher != nil && layer.matcher.Match(layer.path(fn, rel), isdir) {
+			return true
+		}
+	}
+	return false
+}
+
+// Explain returns reason of the first layer, which ignores fn
+func (s *MatcherStack) Explain(fn string, isdir bool) (bool, string) {
+	rel := s.rel(fn)
+	for _, layer := range s.layers {
+		if layer.matcher == nil {
+			continue
+		}
+		ignored, reason := layer.matcher.Explain(layer.path(fn, rel), isdir)
+		if ignored {
+			return true, layer.name + ": " + reason
 		}
+	}
+	return false, ""
+}
+
+func (s *MatcherStack) rel(fn string) string {
+	if s.root == "" || s.root == "." {
+		return fn
+	}
+	rel, err := filepath.Rel(s.root, fn)
+	if err != nil {
+		return fn
+	}
+	return rel
+}
+
+func (l *matcherLayer) path(fn string, rel string) string {
+	if l.name == "exclude" || l.name == "only" || l.name == "type" {
+		return fn
+	}
+	return rel
+}
+
+func (s *MatcherStack) String() string {
+	descs := []string{}
+	for _, layer := range s.layers {
+		if layer.matcher == nil {
+			continue
+		}
+		if desc := fmt.Sprint(layer.matcher); desc != "" {
+			descs = append(descs, desc)
+		}
+	}
+	return strings.Join(descs, "\n")
+}
 
+// Looks for repository in wd and its parents, returns its ignore matcher and
+// root, or nil and wd if there is none
+func NewVCSMatcher(wd string) (Matcher, string) {
+	path := wd
+	for filepath.Dir(path) != path { // top directory
 		if dirExists(filepath.Join(path, ".hg")) {
-			return NewHgMatcher(wd, filepath.Join(path, ".hgignore"))
+			return NewHgMatcher(wd, filepath.Join(path, ".hgignore")), path
 		}
 
 		if dirExists(filepath.Join(path, ".git")) {
-			return NewGitMatcher(wd, filepath.Join(path, ".gitignore"))
+			return NewGitMatcher(wd, filepath.Join(path, ".gitignore")), path
 		}
 
 		path = filepath.Clean(filepath.Join(path, ".."))
 	}
-
-	return NewGeneralMatcher(generalDirs, generalPats)
+	return nil, wd
 }
 
 // Ignore common patterns
@@ -73,22 +209,27 @@ func NewGeneralMatcher(dirs []string, filePats []string) *GeneralMatcher {
 }
 
 func (i *GeneralMatcher) Match(fn string, isdir bool) bool {
+	ignored, _ := i.Explain(fn, isdir)
+	return ignored
+}
+
+func (i *GeneralMatcher) Explain(fn string, isdir bool) (bool, string) {
 	if isdir {
 		base := filepath.Base(fn)
 		for _, x := range i.dirs {
 			if base == x {
-				return true
+				return true, fmt.Sprintf("directory name %s", x)
 			}
 		}
 	}
 
 	for _, x := range i.res {
 		if x.Match([]byte(fn)) {
-			return true
+			return true, fmt.Sprintf("regexp %s", x)
 		}
 	}
 
-	return false
+	return false, ""
 }
 
 func (i *GeneralMatcher) Append(pats []string) {
@@ -106,18 +247,73 @@ func (i *GeneralMatcher) String() string {
 	return "General ignorer"
 }
 
-// read .hgignore and ignore patterns from there
-type HgMatcher struct {
-	prefix string
-	fp     string
-	res    []*regexp.Regexp
-	globs  []string
+// match file names against regular expressions from command line, in "only"
+// mode ignore files which don't match any of them
+type RegexpMatcher struct {
+	res  []*regexp.Regexp
+	only bool
+}
+
+func NewRegexpMatcher(pats []string, only bool) *RegexpMatcher {
+	res := []*regexp.Regexp{}
+	for _, pat := range pats {
+		re, err := regexp.Compile(pat)
+		if err != nil {
+			errhandle(fmt.Errorf("can't compile pattern %s\n", pat), false)
+			continue
+		}
+		res = append(res, re)
+	}
+	return &RegexpMatcher{res, only}
+}
+
+func (i *RegexpMatcher) Match(fn string, isdir bool) bool {
+	ignored, _ := i.Explain(fn, isdir)
+	return ignored
+}
+
+func (i *RegexpMatcher) Explain(fn string, isdir bool) (bool, string) {
+	if i.only {
+		if isdir || len(i.res) == 0 {
+			return false, ""
+		}
+		for _, x := range i.res {
+			if x.MatchString(fn) {
+				return false, fmt.Sprintf("-o %s", x)
+			}
+		}
+		return true, "no -o regexp matches"
+	}
+
+	for _, x := range i.res {
+		if x.MatchString(fn) {
+			return true, fmt.Sprintf("-x %s", x)
+		}
+	}
+	return false, ""
 }
 
-var hgSyntaxes = map[string]bool{
-	"re":     true,
-	"regexp": true,
-	"glob":   false,
+func (i *RegexpMatcher) String() string {
+	if len(i.res) == 0 {
+		return ""
+	}
+
+	desc := "Ignoring files matching"
+	if i.only {
+		desc = "Ignoring files not matching"
+	}
+	for _, x := range i.res {
+		desc += " " + x.String()
+	}
+	return desc
+}
+
+// read .hgignore and ignore patterns from there
+type HgMatcher struct {
+	prefix   string
+	fp       string
+	excludes []string // ignore files from [ui] section of hgrc
+	patterns []*hgPattern
 }
 
 func NewHgMatcher(wd string, fp string) *HgMatcher {
@@ -132,111 +328,68 @@ func NewHgMatcher(wd string, fp string) *HgMatcher {
 		prefix = ""
 	}
 
-	res := []*regexp.Regexp{}
-	globs := []string{}
-
-	f, err := os.Open(fp)
-	if err != nil {
-		return &HgMatcher{prefix, fp, res, globs}
-	}
-
-	reader := bufio.NewReader(f)
-	isRe := true
-	for {
-		line, _, err := reader.ReadLine()
+	seen := make(map[string]bool)
+	patterns, _ := readHgPatterns(fp, basepath, "", seen)
+	excludes := []string{}
+	for _, exclude := range hgIgnoreFiles(basepath) {
+		pats, err := readHgPatterns(exclude, basepath, "", seen)
 		if err != nil {
-			break
-		}
-
-		// strip comments
-		comment := bytes.IndexByte(line, '#')
-		switch comment {
-		case 0:
+			errhandle(fmt.Errorf("skipping unreadable pattern file: %s", err),
+				false)
 			continue
-		case -1:
-		default:
-			line = line[:comment]
-		}
-
-		line = bytes.TrimRight(line, " \t")
-		if len(line) == 0 {
-			continue
-		}
-
-		// if it's a syntax changer
-		if bytes.HasPrefix(line, []byte("syntax:")) {
-			s := bytes.TrimSpace(line[7:])
-			if isre, ok := hgSyntaxes[string(s)]; ok {
-				isRe = isre
-			}
-			continue
-		}
-
-		// actually append line
-		pat := string(line)
-		if isRe {
-			re, err := regexp.Compile(pat)
-			if err != nil {
-				errhandle(fmt.Errorf("can't compile pattern %s\n", pat), false)
-				continue
-			}
-			res = append(res, re)
-		} else {
-			globs = append(globs, pat)
 		}
+		patterns = append(patterns, pats...)
+		excludes = append(excludes, exclude)
 	}
-	return &HgMatcher{prefix, fp, res, globs}
+
+	return &HgMatcher{prefix, fp, excludes, patterns}
 }
 
 func (i *HgMatcher) Match(fn string, isdir bool) bool {
-	if len(i.prefix) > 0 {
-		fn = filepath.Join(i.prefix, fn)
+	ignored, _ := i.Explain(fn, isdir)
+	return ignored
+}
+
+func (i *HgMatcher) Explain(fn string, isdir bool) (bool, string) {
+	// no point in ignore whole current directory
+	if fn == "." {
+		return false, ""
 	}
+
+	rel := filepath.ToSlash(filepath.Join(i.prefix, fn))
 	base := filepath.Base(fn)
 
 	if isdir && base == ".hg" {
-		return true
+		return true, "repository directory"
 	}
 
-	for _, x := range i.res {
-		if x.Match([]byte(fn)) {
-			return true
-		}
+	// outside of repository
+	if rel == ".." || strings.HasPrefix(rel, "../") {
+		return false, "outside of repository"
 	}
 
-	for _, x := range i.globs {
-		if m, _ := filepath.Match(x, base); m {
-			return true
+	for _, x := range i.patterns {
+		if x.Match(rel) {
+			return true, fmt.Sprintf("pattern %s at %s", x, x.Source())
 		}
 	}
 
-	return false
-}
-
-func (i *HgMatcher) Append(pats []string) {
-	for _, pat := range pats {
-		re, err := regexp.Compile(pat)
-		if err != nil {
-			errhandle(fmt.Errorf("can't compile pattern %s\n", pat), false)
-			continue
-		}
-		i.res = append(i.res, re)
-	}
+	return false, ""
 }
 
 func (i *HgMatcher) String() string {
 	desc := fmt.Sprintf("Ignoring patterns from %s:", i.fp)
-	if len(i.res) > 0 {
-		desc += "\n\tregular expressions: "
-		for _, x := range i.res {
+	if len(i.excludes) > 0 {
+		desc = fmt.Sprintf("Ignoring patterns from %s (and %s):", i.fp,
+			strings.Join(i.excludes, ", "))
+	}
+	if len(i.patterns) > 0 {
+		desc += "\n\tpatterns: "
+		for _, x := range i.patterns {
 			desc += x.String() + " "
 		}
 	}
 
-	if len(i.globs) > 0 {
-		desc += "\n\tglobs: " + strings.Join(i.globs, " ")
-	}
-
 	return desc
 }
 
@@ -245,79 +398,8 @@ type GitMatcher struct {
 	basepath string
 	prefix   string
 	fp       string
-	globs    []string // will be used for showing help only
-	globres  []*regexp.Regexp
-	res      []*regexp.Regexp
-}
-
-// many thanks to Steve Losh for this algorithm
-// https://github.com/sjl/friendly-find/blob/master/ffind#L167-216
-func gitGlobRe(s string) *regexp.Regexp {
-	var pat bytes.Buffer
-	if strings.Contains(s, "/") {
-		// Patterns with a slash have to match against the entire pathname, so
-		// they need to be rooted at the beginning
-		pat.WriteString("^./")
-	} else {
-		// Patterns without a slash match against basename, which is simulated
-		// by including last path divider in the pattern
-		pat.WriteString("/")
-	}
-	s = strings.TrimLeft(s, "/")
-
-	i := 0
-	n := len(s)
-
-	for i < n {
-		c := s[i]
-		i += 1
-
-		switch c {
-		case '?':
-			pat.WriteByte('.')
-		case '*':
-			if i == n {
-				pat.WriteString(".*")
-			} else {
-				pat.WriteString("[^/]*")
-			}
-		case '[':
-			j := i
-			if j < n && (s[j] == '!' || s[j] == ']') {
-				j += 1
-			}
-			for j < n && s[j] != ']' {
-				j += 1
-			}
-
-			if j >= n {
-				pat.WriteString("\\[")
-			} else {
-				stuff := strings.Replace(s[i:j], "\\", "\\\\", -1)
-				i = j + 1
-				if stuff[0] == '!' {
-					stuff = "^" + stuff[1:]
-				} else if stuff[0] == '^' {
-					stuff = "\\" + stuff
-				}
-				pat.WriteString("[")
-				pat.WriteString(stuff)
-				pat.WriteString("]")
-			}
-		default:
-			pat.WriteString(regexp.QuoteMeta(string(c)))
-		}
-
-		if i == n && c != '/' {
-			pat.WriteByte('$')
-		}
-	}
-
-	re, err := regexp.Compile(pat.String())
-	if err != nil {
-		errhandle(fmt.Errorf("can't parse pattern '%s': %s", s, err), false)
-	}
-	return re
+	excludes []string // global and repository excludes files, if they exist
+	tree     *IgnoreTree
 }
 
 func NewGitMatcher(wd string, fp string) *GitMatcher {
@@ -332,35 +414,20 @@ func NewGitMatcher(wd string, fp string) *GitMatcher {
 		prefix = ""
 	}
 
-	globs := []string{}
-	globres := []*regexp.Regexp{}
-
-	f, err := os.Open(fp)
-	if err != nil {
-		return &GitMatcher{basepath, prefix, fp, globs, globres, []*regexp.Regexp{}}
-	}
-
-	reader := bufio.NewReader(f)
-	for {
-		line, _, err := reader.ReadLine()
-		if err != nil {
-			break
-		}
-
-		line = bytes.TrimRight(line, " \t")
-		if len(line) == 0 {
-			continue
-		}
+	// .gitignore files take precedence over .git/info/exclude, which takes
+	// precedence over core.excludesFile
+	gitdir := filepath.Join(basepath, ".git")
+	tree := NewIgnoreTree(basepath, filepath.Base(fp))
+	excludes := []string{}
+	for _, exclude := range []string{gitExcludesFile(gitdir),
+		filepath.Join(gitdir, "info", "exclude")} {
 
-		if line[0] == '#' {
-			continue
+		if exclude != "" && tree.AddFile(exclude) {
+			excludes = append(excludes, exclude)
 		}
-
-		globs = append(globs, string(line))
-		globres = append(globres, gitGlobRe(string(line)))
 	}
 
-	return &GitMatcher{basepath, prefix, fp, globs, globres, []*regexp.Regexp{}}
+	return &GitMatcher{basepath, prefix, fp, excludes, tree}
 }
 
 func (i *GitMatcher) Match(fn string, isdir bool) bool {
@@ -369,62 +436,196 @@ func (i *GitMatcher) Match(fn string, isdir bool) bool {
 		return false
 	}
 
-	path := fmt.Sprintf(".%c", filepath.Separator) + filepath.Join(i.prefix, fn)
-	base := filepath.Base(path)
-
-	if filepath.Separator != '/' {
-		path = strings.Replace(path, string(filepath.Separator), "/", -1)
-	}
+	rel := filepath.ToSlash(filepath.Join(i.prefix, fn))
+	base := filepath.Base(fn)
 
 	if isdir && base == ".git" {
 		return true
 	}
 
-	for _, pat := range i.globres {
-		if pat.MatchString(path) {
-			return true
-		}
+	// outside of repository
+	if rel == ".." || strings.HasPrefix(rel, "../") {
+		return false
 	}
 
-	for _, pat := range i.res {
-		if pat.MatchString(path) {
-			return true
-		}
+	return i.tree.Ignored(rel, isdir)
+}
+
+func (i *GitMatcher) Explain(fn string, isdir bool) (bool, string) {
+	if fn == "." {
+		return false, ""
 	}
 
-	return false
+	rel := filepath.ToSlash(filepath.Join(i.prefix, fn))
+	if isdir && filepath.Base(fn) == ".git" {
+		return true, "repository directory"
+	}
+
+	if rel == ".." || strings.HasPrefix(rel, "../") {
+		return false, "outside of repository"
+	}
+
+	return explainTree(i.tree, rel, isdir)
 }
 
-func (i *GitMatcher) Append(pats []string) {
-	for _, pat := range pats {
-		re, err := regexp.Compile(pat)
-		if err != nil {
-			errhandle(fmt.Errorf("can't compile pattern %s\n", pat), false)
-			continue
-		}
-		i.res = append(i.res, re)
+// describes decision of IgnoreTree
+func explainTree(tree *IgnoreTree, rel string, isdir bool) (bool, string) {
+	pat, parent := tree.Explain(rel, isdir)
+	switch {
+	case pat == nil:
+		return false, ""
+	case parent != "":
+		return true, fmt.Sprintf("parent directory %s, pattern %s at %s",
+			parent, pat, pat.Source())
 	}
+	return !pat.negate, fmt.Sprintf("pattern %s at %s", pat, pat.Source())
 }
 
 func (i *GitMatcher) String() string {
 	desc := fmt.Sprintf("Ignoring patterns from %s:", i.fp)
-	if len(i.globs) > 0 {
+	if len(i.excludes) > 0 {
+		desc = fmt.Sprintf("Ignoring patterns from %s (and %s):", i.fp,
+			strings.Join(i.excludes, ", "))
+	}
+	if patterns := i.tree.Patterns(""); len(patterns) > 0 {
 		desc += "\n\tglobs: "
-		for _, x := range i.globs {
-			if strings.HasPrefix(x, i.basepath) {
-				desc += x[len(i.basepath):] + " "
-			} else {
-				desc += x + " "
+		for _, x := range patterns {
+			desc += x.String() + " "
+		}
+	}
+
+	return desc
+}
+
+// read .ignore and .grignore files (gitignore syntax) from every directory,
+// so that projects can have patterns to be ignored by gr but not by VCS
+type ProjectMatcher struct {
+	basepath string
+	prefix   string
+	tree     *IgnoreTree
+}
+
+var projectIgnoreNames = []string{".ignore", ".grignore"}
+
+// Looks for the topmost of wd and its parents with project ignore files, when
+// there is no repository to take root from, so that all of them are read
+// wherever gr is started; returns wd if there is none
+func findProjectRoot(wd string) string {
+	root := wd
+	for path := wd; ; path = filepath.Dir(path) {
+		for _, name := range projectIgnoreNames {
+			if fi, err := os.Stat(filepath.Join(path, name)); err == nil && !fi.IsDir() {
+				root = path
 			}
 		}
+		if filepath.Dir(path) == path { // top directory
+			return root
+		}
 	}
+}
 
-	if len(i.res) > 0 {
-		desc += "\n\tregular expressions: "
-		for _, x := range i.res {
-			desc += x.String() + " "
+func NewProjectMatcher(wd string, basepath string) *ProjectMatcher {
+	prefix, err := filepath.Rel(basepath, wd)
+	if err != nil || prefix == "." {
+		prefix = ""
+	}
+	tree := NewIgnoreTree(basepath, projectIgnoreNames...)
+	return &ProjectMatcher{basepath, prefix, tree}
+}
+
+func (i *ProjectMatcher) Match(fn string, isdir bool) bool {
+	// no point in ignore whole current directory
+	if fn == "." {
+		return false
+	}
+
+	rel := filepath.ToSlash(filepath.Join(i.prefix, fn))
+
+	// outside of project
+	if rel == ".." || strings.HasPrefix(rel, "../") {
+		return false
+	}
+
+	return i.tree.Ignored(rel, isdir)
+}
+
+func (i *ProjectMatcher) Explain(fn string, isdir bool) (bool, string) {
+	if fn == "." {
+		return false, ""
+	}
+
+	rel := filepath.ToSlash(filepath.Join(i.prefix, fn))
+	if rel == ".." || strings.HasPrefix(rel, "../") {
+		return false, "outside of project"
+	}
+
+	return explainTree(i.tree, rel, isdir)
+}
+
+func (i *ProjectMatcher) String() string {
+	patterns := i.tree.Patterns("")
+	if len(patterns) == 0 {
+		return ""
+	}
+
+	desc := fmt.Sprintf("Ignoring patterns from %s:",
+		strings.Join(projectIgnoreNames, ", "))
+	desc += "\n\tglobs: "
+	for _, x := range patterns {
+		desc += x.String() + " "
+	}
+	return desc
+}
+
+// GlobMatcher applies gitignore-style globs from -g in order, the last
+// matching one decides: "!GLOB" skips a file or directory, while GLOB keeps a
+// file. If there are globs without "!", files matching none of them are
+// skipped.
+type GlobMatcher struct {
+	globs   []*gitPattern
+	include bool
+}
+
+func NewGlobMatcher(globs []string, casefold bool) *GlobMatcher {
+	m := &GlobMatcher{}
+	for _, glob := range globs {
+		pat := parseGitPattern(glob)
+		if pat == nil {
+			errhandle(fmt.Errorf("ignoring empty glob '%s'", glob), false)
+			continue
+		}
+		pat.casefold = casefold
+		m.globs = append(m.globs, pat)
+		m.include = m.include || !pat.negate
+	}
+	return m
+}
+
+func (m *GlobMatcher) Match(fn string, isdir bool) bool {
+	ignored, _ := m.Explain(fn, isdir)
+	return ignored
+}
+
+func (m *GlobMatcher) Explain(fn string, isdir bool) (bool, string) {
+	path := filepath.ToSlash(fn)
+	for j := len(m.globs) - 1; j >= 0; j-- {
+		if m.globs[j].Match(path, isdir) {
+			return m.globs[j].negate, "-g " + m.globs[j].String()
 		}
 	}
+	if m.include && !isdir {
+		return true, "no -g glob matches"
+	}
+	return false, ""
+}
 
+func (m *GlobMatcher) String() string {
+	if len(m.globs) == 0 {
+		return ""
+	}
+	desc := "Filtering files with globs"
+	for _, pat := range m.globs {
+		desc += " " + pat.String()
+	}
 	return desc
 }
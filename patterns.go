@@ -0,0 +1,165 @@
+// (c) 2011-2014 Alexander Solovyov
+// under terms of ISC license
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Pattern is one or several regular expressions, which are searched for in a
+// single pass: they are combined in one regexp, where every one of them is a
+// group, so it's known which one has matched
+type Pattern struct {
+	re       *regexp.Regexp   // combined
+	res      []*regexp.Regexp // every pattern on its own
+	groups   []int            // index of group of every pattern in re
+	replaces []string         // replacement of every pattern
+}
+
+// NewPattern compiles patterns, applying -p and -i to each of them
+func NewPattern(pats []string, replaces []string) (*Pattern, error) {
+	p := &Pattern{}
+	var parts []string
+	group := 1
+	for _, pat := range pats {
+		if opts.PlainText {
+			pat = regexp.QuoteMeta(pat)
+		}
+		if opts.IgnoreCase {
+			pat = "(?i:" + pat + ")"
+		}
+
+		re, err := regexp.Compile(pat)
+		if err != nil {
+			return nil, err
+		}
+		if re.Match([]byte("")) {
+			if len(pats) > 1 {
+				return nil, fmt.Errorf("Your pattern matches empty string: %s", pat)
+			}
+			return nil, fmt.Errorf("Your pattern matches empty string")
+		}
+
+		p.res = append(p.res, re)
+		p.groups = append(p.groups, group)
+		group += 1 + re.NumSubexp()
+		parts = append(parts, "("+pat+")")
+	}
+
+	if len(p.res) == 1 {
+		p.re, p.groups = p.res[0], nil
+	} else {
+		p.re = regexp.MustCompile(strings.Join(parts, "|"))
+	}
+
+	switch len(replaces) {
+	case 0:
+	case 1:
+		for range p.res {
+			p.replaces = append(p.replaces, replaces[0])
+		}
+	case len(p.res):
+		p.replaces = replaces
+	default:
+		return nil, fmt.Errorf("Got %d replacements for %d patterns, give either one for all of them or one for each",
+			len(replaces), len(p.res))
+	}
+	return p, nil
+}
+
+// Reads patterns file, one pattern per line, skipping empty lines
+func readPatterns(fp string) ([]string, error) {
+	f, err := os.Open(fp)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var pats []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if line := scanner.Text(); line != "" {
+			pats = append(pats, line)
+		}
+	}
+	return pats, scanner.Err()
+}
+
+// Unescapes replacements, so that "\n" and alike can be used in them
+func unquoteReplaces(replaces []string) []string {
+	res := make([]string, len(replaces))
+	for i, s := range replaces {
+		unquoted, err := strconv.Unquote(`"` + s + `"`)
+		errhandle(err, true)
+		res[i] = unquoted
+	}
+	return res
+}
+
+func (p *Pattern) String() string {
+	descs := make([]string, len(p.res))
+	for i, re := range p.res {
+		descs[i] = re.String()
+	}
+	return strings.Join(descs, ", ")
+}
+
+// Several tells if there is more than one pattern
+func (p *Pattern) Several() bool {
+	return len(p.res) > 1
+}
+
+// FindAll returns submatch indexes of all matches in b, as they would be
+// returned by the pattern, which matched, and which pattern it was (which is
+// nil if there is only one pattern)
+func (p *Pattern) FindAll(b []byte) (matches [][]int, which []int) {
+	matches = p.re.FindAllSubmatchIndex(b, -1)
+	if p.groups == nil || matches == nil {
+		return matches, nil
+	}
+
+	which = make([]int, len(matches))
+	for i, m := range matches {
+		for j, group := range p.groups {
+			if m[2*group] != -1 {
+				n := 1 + p.res[j].NumSubexp()
+				matches[i], which[i] = m[2*group:2*(group+n)], j
+				break
+			}
+		}
+	}
+	return matches, which
+}
+
+func (p *Pattern) FindAllStringIndex(s string) [][]int {
+	return p.re.FindAllStringIndex(s, -1)
+}
+
+// Expand returns replacement of i-th match m in content, with which being
+// as returned by FindAll
+func (p *Pattern) Expand(content []byte, m []int, which []int, i int) []byte {
+	j := 0
+	if which != nil {
+		j = which[i]
+	}
+	return p.res[j].Expand(nil, []byte(p.replaces[j]), content, m)
+}
+
+// Replaces returns replacement of every pattern
+func (p *Pattern) Replaces() string {
+	if len(p.replaces) == 0 {
+		return ""
+	}
+	for _, r := range p.replaces[1:] {
+		if r != p.replaces[0] {
+			return strings.Join(p.replaces, ", ")
+		}
+	}
+	return p.replaces[0]
+}
@@ -0,0 +1,319 @@
+// (c) 2011-2014 Alexander Solovyov
+// under terms of ISC license
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+)
+
+// path, which means standard input, and the name it's printed with
+const (
+	stdinPath = "-"
+	stdinName = "<stdin>"
+)
+
+// Reports if standard input is redirected from a pipe or a file, so that it
+// should be searched when no paths are given
+func stdinPiped() bool {
+	fi, err := os.Stdin.Stat()
+	if err != nil {
+		return false
+	}
+	return fi.Mode()&os.ModeNamedPipe != 0 || fi.Mode().IsRegular()
+}
+
+// SearchStdin searches standard input, or writes it with replacements made to
+// standard output, like sed does. Its results are separated from groups of
+// files printed before, if grouped is set, and it returns if there are any
+// groups printed after it.
+func (v *GRVisitor) SearchStdin(grouped bool) bool {
+	if len(opts.Replace) == 0 || opts.DryRun {
+		w := *v
+		w.printer = v.printer.Fork(os.Stdout)
+		if tp, ok := w.printer.(*TextPrinter); ok && grouped {
+			tp.previous = stdinPath
+		}
+		w.SearchStream(stdinName, os.Stdin)
+		return grouped || w.printer.Grouped()
+	}
+
+	if v.prompter != nil {
+		errhandle(fmt.Errorf("Can't ask for confirmation when replacing in %s",
+			stdinName), true)
+	}
+	out := bufio.NewWriter(os.Stdout)
+	defer out.Flush()
+	v.ReplaceStream(stdinName, os.Stdin, out)
+	return grouped
+}
+
+// size of lineReader's buffer, which is the longest line it returns whole,
+// and how much of its end is repeated in the next piece of a longer line
+const (
+	streamWindow  = 1024 * 1024
+	streamOverlap = 4 * 1024
+)
+
+// lineReader splits a stream into lines using a buffer of fixed size, so that
+// memory use is bounded regardless of stream size. Lines longer than the
+// buffer are returned in pieces, each of which starts with the last
+// streamOverlap bytes of the previous one, so that matches crossing their
+// boundaries are not lost.
+type lineReader struct {
+	r          io.Reader
+	buf        []byte
+	begin, end int   // unread part of buf
+	base       int64 // position of buf[0] in the stream
+	err        error
+	more       bool // the last line is not returned whole yet
+
+	// describe the last line returned by Next
+	offset  int64 // its position in the stream
+	column  int   // its position in the line, if it's a piece
+	cont    bool  // it's a continuation of the previous piece
+	newline bool  // it ended with a newline
+}
+
+func newLineReader(r io.Reader) *lineReader {
+	return &lineReader{r: r, buf: make([]byte, streamWindow)}
+}
+
+// Next returns next line (or a piece of it) without newline; it's valid only
+// until the next call
+func (lr *lineReader) Next() ([]byte, error) {
+	lr.cont = lr.more
+	if lr.cont {
+		lr.column += len(lr.buf) - streamOverlap
+	} else {
+		lr.column = 0
+	}
+	for {
+		data := lr.buf[lr.begin:lr.end]
+		if i := bytes.IndexByte(data, '\n'); i != -1 {
+			lr.offset, lr.newline, lr.more = lr.base+int64(lr.begin), true, false
+			lr.begin += i + 1
+			return data[:i], nil
+		}
+
+		full := lr.begin == 0 && lr.end == len(lr.buf)
+		if full || (lr.err != nil && len(data) > 0) {
+			lr.offset, lr.newline, lr.more = lr.base+int64(lr.begin), false, full
+			lr.begin = lr.end
+			if full {
+				lr.begin -= streamOverlap
+			}
+			return data, nil
+		}
+		if lr.err != nil {
+			return nil, lr.err
+		}
+
+		copy(lr.buf, data)
+		lr.base += int64(lr.begin)
+		lr.begin, lr.end = 0, len(data)
+
+		n, err := lr.r.Read(lr.buf[lr.end:])
+		lr.end += n
+		lr.err = err
+	}
+}
+
+// matches of a line (or a piece of it), except ones already found in previous
+// pieces, which end at lastEnd, and ones starting in the last streamOverlap
+// bytes of a piece, which are found whole in the next one
+func (lr *lineReader) matches(pattern *Pattern, line []byte, lastEnd int64) ([][]int, []int) {
+	// search after the last match only, so that it doesn't hide the next one
+	skip := 0
+	if lr.cont && lastEnd > lr.offset {
+		skip = int(lastEnd - lr.offset)
+		if skip > len(line) {
+			skip = len(line)
+		}
+	}
+	matches, which := pattern.FindAll(line[skip:])
+	if skip == 0 && !lr.more {
+		return matches, which
+	}
+
+	var res [][]int
+	var resWhich []int
+	for i, m := range matches {
+		if lr.more && skip+m[0] >= len(line)-streamOverlap {
+			break
+		}
+		for j := range m {
+			if m[j] != -1 {
+				m[j] += skip
+			}
+		}
+		res = append(res, m)
+		if which != nil {
+			resWhich = append(resWhich, which[i])
+		}
+	}
+	return res, resWhich
+}
+
+// line of a stream, which is kept for before-context
+type streamLine struct {
+	num  int
+	text []byte
+}
+
+// SearchStream searches r line by line, printing matches as soon as lines
+// with them are read, so that endless streams (like output of `tail -f`) can
+// be searched too, and huge files are searched with bounded memory. Matches
+// can't span lines here.
+func (v *GRVisitor) SearchStream(fn string, r io.Reader) {
+	stats := &FileStats{}
+	defer v.printer.End(fn, stats)
+
+	before, after := contextSize()
+	var history []*streamLine
+	// last printed line and how many lines of after-context it wants
+	last, pending := 0, 0
+	// end of the last match, to skip it in the next piece of a long line
+	var lastEnd int64
+
+	reader := newLineReader(r)
+	num := 0
+	for {
+		line, err := reader.Next()
+		if err != nil {
+			if err != io.EOF {
+				errhandle(fmt.Errorf("Error reading %s: %s", fn, err), false)
+			}
+			if opts.WithoutMatch && stats.Lines == 0 {
+				v.printer.FileName(fn)
+			}
+			return
+		}
+		if !reader.cont {
+			num++
+		}
+
+		matches, which := reader.matches(v.pattern, line, lastEnd)
+		if (matches == nil) != opts.InvertMatch {
+			switch {
+			case pending > 0:
+				v.printer.Context(fn, num, line)
+				last = num
+				pending--
+			case before > 0:
+				history = append(history,
+					&streamLine{num, append([]byte(nil), line...)})
+				if len(history) > before {
+					history = history[1:]
+				}
+			}
+			continue
+		}
+
+		if stats.Lines == 0 {
+			if opts.WithoutMatch {
+				stats.Lines++
+				return
+			}
+			if opts.OnlyName {
+				v.printer.FileName(fn)
+				return
+			}
+			v.printer.Begin(fn, 0)
+		}
+		stats.Lines++
+		if opts.InvertMatch {
+			stats.Matches++
+		} else {
+			stats.Matches += len(matches)
+			lastEnd = reader.offset + int64(matches[len(matches)-1][1])
+		}
+
+		if bytes.IndexByte(line, 0) != -1 {
+			v.printer.BinaryMatch(fn)
+			return
+		}
+
+		if before > 0 || after > 0 {
+			first := num
+			if len(history) > 0 {
+				first = history[0].num
+			}
+			if last > 0 && first > last+1 {
+				v.printer.Break(fn)
+			}
+			for _, prev := range history {
+				v.printer.Context(fn, prev.num, prev.text)
+			}
+			history = history[:0]
+		}
+
+		v.printer.Match(fn, &LineInfo{num, line, 0, len(line), line, matches,
+			which, int(reader.offset), reader.column})
+		last = num
+		pending = after
+	}
+}
+
+// ReplaceStream copies r to out line by line, with replacements made, and
+// flushes out whenever there is nothing more to read yet
+func (v *GRVisitor) ReplaceStream(fn string, r io.Reader, out *bufio.Writer) {
+	if opts.SingleLine {
+		errhandle(fmt.Errorf("Can't handle singleline replacements"),
+			true)
+	}
+
+	if opts.PlainText {
+		errhandle(fmt.Errorf("Can't handle plain text replacements"),
+			true)
+	}
+
+	reader := newLineReader(r)
+	// everything before this position is already written
+	var written int64
+	for {
+		line, err := reader.Next()
+		if err != nil {
+			if err != io.EOF {
+				errhandle(fmt.Errorf("Error reading %s: %s", fn, err), false)
+			}
+			return
+		}
+
+		last := int(written - reader.offset)
+		if last < 0 {
+			last = 0
+		}
+		matches, which := reader.matches(v.pattern, line, written)
+		for i, bounds := range matches {
+			out.Write(line[last:bounds[0]])
+			out.Write(v.pattern.Expand(line, bounds, which, i))
+			last = bounds[1]
+		}
+		// the rest of a piece is repeated in the next one, where matches
+		// starting there are found whole
+		end := len(line)
+		if reader.more {
+			end = len(line) - streamOverlap
+			if end < last {
+				end = last
+			}
+		}
+		out.Write(line[last:end])
+		written = reader.offset + int64(end)
+		if reader.newline {
+			out.Write(byteNewLine)
+			written++
+		}
+
+		if reader.begin == reader.end {
+			if err := out.Flush(); err != nil {
+				errhandle(fmt.Errorf("Error writing replacement: %s", err), true)
+			}
+		}
+	}
+}
@@ -3,34 +3,84 @@ Go Replace tests:
   $ START_DIR=$PWD && cd $TESTDIR && cd ./.. && go build -o $START_DIR/gr && cd $START_DIR
   $ alias gr="$START_DIR/gr -c"
 
+Commands here get this script as their standard input, so it's not searched:
+
+  $ export XDG_CONFIG_HOME=$START_DIR/.xdg && mkdir -p $XDG_CONFIG_HOME/gr
+  $ echo --no-stdin > $XDG_CONFIG_HOME/gr/config
+
 Usage:
 
   $ gr
   Usage:
-    gr [OPTIONS] string-to-search
+    gr [OPTIONS] string-to-search [PATH...]
   
-  Ignoring files bigger than 10MB
+  Searching files bigger than 10MB line by line
   General ignorer
   
   Application Options:
-    -r, --replace=RE        replace found substrings with RE
-        --force             force replacement in binary files
-        --dry-run           prints replacements without modifying files
-    -i, --ignore-case       ignore pattern case
-    -s, --singleline        ^/$ will match beginning/end of line
-    -p, --plain             treat pattern as plain text
-    -x, --exclude=RE        exclude filenames that match regexp RE (multi)
-    -o, --only=RE           search only filenames that match regexp RE (multi)
-    -I, --no-autoignore     do not read .git/.hgignore files
-    -b, --big-file=SIZE     ignore files bigger than SIZE (use suffixes: k, M)
-    -B, --no-bigignore      do not ignore big files at all
-    -f, --find-files        search in file names
-    -n, --filename          print only filenames
-    -v, --verbose           show non-fatal errors (like unreadable files)
-    -c, --no-colors         do not show colors in output
-    -N, --no-group          print file name before each line
-    -V, --version           show version and exit
-    -h, --help              show this help message
+    -r, --replace=RE                replace found substrings with RE (multi, one
+                                    per -e)
+        --force                     force replacement in binary files
+        --dry-run                   print diff of replacements without modifying
+                                    files
+        --diff                      print replacements as unified diff
+    -U, --unified=N                 show N lines of context in diff (default: 3)
+        --undo                      undo replacements made by the last run
+        --interactive               ask before every replacement
+        --backup=SUFFIX             save original files with SUFFIX (default: ~)
+        --backup-dir=DIR            save original files to DIR
+        --backup-overwrite          overwrite existing backups
+        --links=MODE                how to write to links: follow (default),
+                                    replace
+    -e, --regexp=PATTERN            search for PATTERN (multi)
+    -F, --file=FILE                 read patterns from FILE, one per line (multi)
+    -i, --ignore-case               ignore pattern case
+    -s, --singleline                ^/$ will match beginning/end of line
+    -p, --plain                     treat pattern as plain text
+    -x, --exclude=RE                exclude filenames that match regexp RE (multi)
+    -o, --only=RE                   search only filenames that match regexp RE
+                                    (multi)
+    -g, --glob=GLOB                 search only files matching GLOB, skip ones
+                                    matching !GLOB (multi)
+        --glob-case-insensitive     ignore case in -g globs
+    -t, --type=TYPE                 search only files of type TYPE (multi)
+    -T, --type-not=TYPE             do not search files of type TYPE (multi)
+        --type-add=DEF              define type as NAME:GLOB[,GLOB...] (multi)
+        --type-list                 print known file types
+    -I, --no-autoignore             do not read .gitignore/.hgignore/.ignore files
+        --no-layer=NAME             disable ignore layer NAME: general, vcs,
+                                    project, exclude, only, glob or type (multi)
+        --layer=NAME                re-enable ignore layer NAME (multi)
+        --explain=PATH              explain why PATH is searched or skipped
+        --files                     print files which would be searched
+        --list-ignored              print skipped files and directories with
+                                    reasons
+    -0, --null                      separate names with NUL in
+                                    --files/--list-ignored
+    -b, --big-file=SIZE             search files bigger than SIZE line by line
+                                    and don't replace in them (use suffixes: k, M)
+    -B, --no-bigignore              read big files whole, like any other
+    -f, --find-files                search in file names
+    -L, --files-without-match       print only names of files without matches
+        --invert-match              print lines which don't match
+    -n, --filename                  print only filenames
+    -v, --verbose                   show non-fatal errors (like unreadable files)
+    -c, --no-colors                 do not show colors in output
+    -N, --no-group                  print file name before each line
+        --json                      print results as JSON Lines
+    -A, --after-context=N           print N lines after each match
+        --before-context=N          print N lines before each match
+    -C, --context=N                 print N lines around each match
+    -j, --jobs=N                    search N files in parallel (default: number
+                                    of CPUs)
+        --unordered                 print results as they come, not in path order
+        --no-stdin                  do not search piped standard input when no
+                                    paths are given
+        --no-config                 do not read config files and $GR_OPTS
+        --print-config              print options in effect and where they come
+                                    from
+    -V, --version                   show version and exit
+    -h, --help                      show this help message
 
 Find a string in a file:
 
@@ -41,6 +91,68 @@ Find a string in a file:
   1:test
   $ cd ..
 
+Check that results of parallel search are printed in path order:
+
+  $ mkdir ordered && cd ordered
+  $ mkdir a b
+  $ echo test > a/one
+  $ echo test > b/two
+  $ echo test > c
+  $ gr -j 3 test
+  a/one
+  1:test
+  
+  b/two
+  1:test
+  
+  c
+  1:test
+  $ gr -j 3 -N test
+  a/one:1:test
+  b/two:1:test
+  c:1:test
+  $ cd ..
+
+Check that context lines are printed and merged:
+
+  $ mkdir context && cd context
+  $ printf 'one\ntwo\nfoo\nthree\nfour\nfive\nsix\nfoo\nseven\nfoo\n' > a
+  $ gr -C 1 foo
+  a
+   2-two
+   3:foo
+   4-three
+  --
+   7-six
+   8:foo
+   9-seven
+  10:foo
+  $ gr -A 1 -N foo
+  a:3:foo
+  a-4-three
+  --
+  a:8:foo
+  a-9-seven
+  a:10:foo
+  $ cd ..
+
+Check JSON output:
+
+  $ mkdir json && cd json
+  $ printf 'one\nfoo bar\n' > a
+  $ gr --json 'f(o)o'
+  {"type":"begin","path":"a"}
+  {"type":"match","path":"a","line":2,"column":1,"start":4,"end":7,"text":"foo","line_text":"foo bar","submatches":[{"start":5,"end":6,"text":"o"}]}
+  {"type":"end","path":"a","matches":1,"replacements":0}
+  {"type":"summary","matches":1,"replacements":0,"files":1,"files_matched":1,"elapsed":.*} (re)
+  $ gr --json bar -r baz --dry-run
+  {"type":"begin","path":"a"}
+  {"type":"replace","path":"a","line":2,"column":5,"start":8,"end":11,"before":"bar","after":"baz"}
+  {"type":"diff","path":"a","diff":"--- a\n+++ a\n@@ -1,2 +1,2 @@\n one\n-foo bar\n+foo baz\n"}
+  {"type":"end","path":"a","matches":0,"replacements":1}
+  {"type":"summary","matches":0,"replacements":1,"files":1,"files_matched":1,"elapsed":.*} (re)
+  $ cd ..
+
 Check that fnmatch-style gitignore patterns are handled:
 
   $ mkdir fnmatch && cd fnmatch
@@ -52,7 +164,21 @@ Check that fnmatch-style gitignore patterns are handled:
   1:test
   $ echo "one/*" > .gitignore
   $ gr test
-  $ cd ..  
+  $ echo "/two/" > .gitignore
+  $ gr test
+  one/two/three
+  1:test
+  $ echo "two/" > .gitignore
+  $ gr test
+  $ echo "**/two/**" > .gitignore
+  $ gr test
+  $ echo "one/**/three" > .gitignore
+  $ gr test
+  $ echo "three/" > .gitignore
+  $ gr test
+  one/two/three
+  1:test
+  $ cd ..
 
 Check plain text searching:
 
@@ -74,6 +200,650 @@ Check that anchored directories are properly ignored:
   $ gr test
   $ cd ..
 
+Check that negated gitignore patterns re-include files, unless their parent
+directory is excluded:
+
+  $ mkdir negate && cd negate
+  $ mkdir .git logs keep
+  $ echo test > a.log
+  $ echo test > important.log
+  $ echo test > logs/important.log
+  $ echo test > keep/a
+  $ echo test > keep/b
+  $ echo test > '#hash'
+  $ printf '*.log\n!important.log\nlogs/\nkeep/*\n!keep/a\n\\#hash\n' > .gitignore
+  $ gr -n test
+  important.log
+  keep/a
+  $ cd ..
+
+Check that .gitignore files in subdirectories are scoped to their directory:
+
+  $ mkdir nested-ignores && cd nested-ignores
+  $ mkdir -p .git frontend/build frontend/src other/build
+  $ echo test > frontend/build/one
+  $ echo test > frontend/src/two
+  $ echo test > other/build/three
+  $ echo build/ > frontend/.gitignore
+  $ gr -n test
+  frontend/src/two
+  other/build/three
+  $ cd frontend
+  $ gr -n test
+  src/two
+  $ cd ../..
+
+Check that .git/info/exclude and global excludes file are read:
+
+  $ mkdir excludes && cd excludes
+  $ mkdir -p .git/info home/.config/git
+  $ echo test > one.info
+  $ echo test > two.global
+  $ echo test > three.configured
+  $ echo test > four
+  $ echo '*.info' > .git/info/exclude
+  $ echo '*.global' > home/.config/git/ignore
+  $ (export HOME=$PWD/home XDG_CONFIG_HOME=; gr -n test -x home < /dev/null)
+  four
+  three.configured
+  $ printf '[core]\n\texcludesFile = "~/ignore"\n' > home/.gitconfig
+  $ echo '*.configured' > home/ignore
+  $ (export HOME=$PWD/home XDG_CONFIG_HOME=; gr -n test -x home < /dev/null)
+  four
+  two.global
+  $ echo '!*.info' > .gitignore
+  $ (export HOME=$PWD/home XDG_CONFIG_HOME=; gr -n test -x home < /dev/null)
+  four
+  one.info
+  two.global
+  $ cd ..
+
+Check .hgignore syntaxes, includes and ignore files from hgrc:
+
+  $ mkdir hgsyntax && cd hgsyntax
+  $ mkdir -p .hg build/x src/gen docs
+  $ for f in build/x/a src/gen/b src/c docs/d.txt docs/e.md top.log; do
+  >   echo test > $f
+  > done
+  $ gr -n test
+  build/x/a
+  docs/d.txt
+  docs/e.md
+  src/c
+  src/gen/b
+  top.log
+  $ printf 'syntax: glob\n*.log\nrootglob:build\nsubinclude:src/ignore\n' > .hgignore
+  $ echo 'gen' > src/ignore
+  $ gr -n test
+  docs/d.txt
+  docs/e.md
+  src/c
+  $ echo 'include:docs-ignore' >> .hgignore
+  $ echo 're:^docs/.*\.txt$' > docs-ignore
+  $ printf '[ui]\nignore.local = local-ignore\n' > .hg/hgrc
+  $ echo 'path:docs/e.md' > local-ignore
+  $ gr -n test
+  src/c
+  $ cd src && gr -n test
+  c
+  $ cd ../..
+
+Check that .ignore and .grignore are read with or without VCS:
+
+  $ mkdir project && cd project
+  $ mkdir -p vendor sub/fixtures
+  $ for f in one.txt vendor/two sub/three sub/fixtures/four; do
+  >   echo test > $f
+  > done
+  $ printf 'vendor/\n*.gen\n' > .ignore
+  $ echo 'fixtures' > sub/.grignore
+  $ echo test > sub/five.gen
+  $ gr -n test
+  one.txt
+  sub/three
+  $ cd sub && gr -n test
+  three
+  $ cd .. && rm sub/five.gen
+  $ mkdir -p lib/vendor && echo test > lib/five && echo test > lib/vendor/six
+  $ cd lib && gr -n test
+  five
+  $ gr --explain vendor/six | grep project: | head -1
+    project:  ignored (pattern vendor/ at */project/.ignore:1) (glob)
+  $ cd .. && rm -r lib
+  $ mkdir .git && echo '*.txt' > .gitignore
+  $ echo '!vendor/' > .grignore
+  $ gr -n test
+  sub/three
+  vendor/two
+  $ cd ..
+
+Check that ignore layers are combined and can be switched off:
+
+  $ mkdir layers && cd layers
+  $ mkdir -p .git .svn src
+  $ echo test > .svn/entries
+  $ echo test > src/one.py
+  $ echo test > src/one.pyc
+  $ echo test > src/two.txt
+  $ echo test > generated.txt
+  $ echo generated.txt > .gitignore
+  $ gr -n test
+  src/one.py
+  src/two.txt
+  $ gr -n test --no-layer general
+  .svn/entries
+  src/one.py
+  src/one.pyc
+  src/two.txt
+  $ gr -n test -I
+  generated.txt
+  src/one.py
+  src/two.txt
+  $ gr -n test -I --layer vcs
+  src/one.py
+  src/two.txt
+  $ gr -n test -x two -o '\.py'
+  src/one.py
+  $ gr -n test -x two --no-layer exclude
+  src/one.py
+  src/two.txt
+  $ gr -n test --no-layer unknown
+  unknown layer 'unknown', should be one of: general, vcs, project, exclude, only, glob, type
+  [1]
+  $ cd ..
+
+Check that reasons of skipping files are explained:
+
+  $ mkdir explain && cd explain
+  $ mkdir -p .git build
+  $ echo test > build/one
+  $ echo test > two.log
+  $ echo test > keep.log
+  $ printf 'a\0b' > binary
+  $ printf 'build/\n*.log\n!keep.log\n' > .gitignore
+  $ gr --explain build/one
+  build (parent directory)
+    general:  not ignored
+    vcs:      ignored (pattern build/ at .gitignore:1)
+    project:  not ignored
+    exclude:  not ignored
+    only:     not ignored
+    glob:     not ignored
+    type:     not ignored
+  build/one
+    general:  not ignored
+    vcs:      ignored (parent directory build, pattern build/ at .gitignore:1)
+    project:  not ignored
+    exclude:  not ignored
+    only:     not ignored
+    glob:     not ignored
+    type:     not ignored
+    empty:    no
+    symlink:  no
+    big:      no (5B, limit is 10MB)
+    binary:   no
+  skipped
+  $ gr --explain keep.log --no-layer project -x '^k' -b 4
+  keep.log
+    general:  not ignored
+    vcs:      not ignored (pattern !keep.log at .gitignore:3)
+    project:  disabled
+    exclude:  ignored (-x ^k)
+    only:     not ignored
+    glob:     not ignored
+    type:     not ignored
+    empty:    no
+    symlink:  no
+    big:      yes (5B, limit is 4B), searched line by line
+  skipped
+  $ gr --explain binary
+  binary
+    general:  not ignored
+    vcs:      not ignored
+    project:  not ignored
+    exclude:  not ignored
+    only:     not ignored
+    glob:     not ignored
+    type:     not ignored
+    empty:    no
+    symlink:  no
+    big:      no (3B, limit is 10MB)
+    binary:   yes (matching lines are not printed, replacing needs --force)
+  searched
+
+Paths are explained with ignores of the searched path they are in, or of their
+own repository, and backup directory is reported too:
+
+  $ mkdir -p ../explain-other/.git ../explain-other/gen bak
+  $ echo test > ../explain-other/gen/x && echo test > bak/y
+  $ echo 'gen/' > ../explain-other/.gitignore
+  $ gr --explain ../explain-other/gen/x . ../explain-other | grep -v ' not '
+  ../explain-other/gen (parent directory)
+    vcs:      ignored (pattern gen/ at */explain-other/.gitignore:1) (glob)
+  ../explain-other/gen/x
+    vcs:      ignored (parent directory gen, pattern gen/ at */explain-other/.gitignore:1) (glob)
+    empty:    no
+    symlink:  no
+    big:      no (5B, limit is 10MB)
+    binary:   no
+  skipped
+  $ gr --explain ../explain-other/gen/x | grep vcs:
+    vcs:      ignored (parent directory gen, pattern gen/ at */explain-other/.gitignore:1) (glob)
+  $ gr --explain bak/y --backup-dir bak | grep -v ' not '
+  bak (parent directory)
+    backup:   yes (--backup-dir)
+  bak/y
+    empty:    no
+    symlink:  no
+    big:      no (5B, limit is 10MB)
+    binary:   no
+  skipped
+  $ gr --explain bak | head -2
+  bak
+    general:  not ignored
+  $ rm -r ../explain-other bak
+  $ cd ..
+
+Check listing of searched and skipped files:
+
+  $ mkdir listing && cd listing
+  $ mkdir -p .git build src
+  $ echo test > build/one
+  $ echo test > src/two.c
+  $ echo test > src/two.o
+  $ echo test > 'with space'
+  $ touch empty
+  $ echo build/ > .gitignore
+  $ gr --files
+  .gitignore
+  src/two.c
+  with space
+  $ gr --files -0 | xargs -0 cat
+  build/
+  test
+  test
+  $ gr --list-ignored
+  .git\tgeneral: directory name .git (esc)
+  build\tvcs: pattern build/ at .gitignore:1 (esc)
+  empty\tempty (esc)
+  src/two.o\tgeneral: regexp \\.o$ (esc)
+  $ gr --list-ignored -0 | tr '\0' '\n'
+  .git
+  build
+  empty
+  src/two.o
+  $ cd ..
+
+Check searching in paths given on command line:
+
+  $ mkdir roots && cd roots
+  $ mkdir -p a/.git a/src a/build b/.git b/lib
+  $ echo build > a/.gitignore
+  $ echo '*.txt' > b/.gitignore
+  $ echo test > a/src/x
+  $ echo test > a/build/y
+  $ echo test > b/lib/z.txt
+  $ echo test > b/lib/w
+  $ gr -n test a ./b/ a/build/y missing
+  stat missing: no such file or directory
+  a/src/x
+  ./b/lib/w
+  a/build/y
+  $ cd a && gr -N test ../b src
+  ../b/lib/w:1:test
+  src/x:1:test
+  $ gr --files . ../b
+  .gitignore
+  src/x
+  ../b/.gitignore
+  ../b/lib/w
+  $ cd ../..
+
+Check searching in standard input:
+
+  $ mkdir stdin && cd stdin
+  $ echo 'foo in file' > file
+  $ printf 'one\ntwo foo\nthree\nfour\nfive\nsix foo\n' > input
+  $ gr --no-config foo < input
+  <stdin>
+  2:two foo
+  6:six foo
+  $ gr foo - < input
+  <stdin>
+  2:two foo
+  6:six foo
+  $ cat input | gr --no-config --no-stdin -n foo
+  file
+  input
+  $ cat input | gr --no-config -A1 foo
+  <stdin>
+  2:two foo
+  3-three
+  --
+  6:six foo
+  $ echo 'a foo' | gr foo file - file
+  file
+  1:foo in file
+  
+  <stdin>
+  1:a foo
+  
+  file
+  1:foo in file
+  $ echo 'a foo' | gr -N foo file -
+  file:1:foo in file
+  <stdin>:1:a foo
+  $ echo 'b foo' | gr --json foo - | grep '"match"'
+  {"type":"match","path":"\u003cstdin\u003e","line":1,"column":3,"start":2,"end":5,"text":"foo","line_text":"b foo"}
+  $ cat input | gr 'f(o+)' -r 'b$1' - | tail -n 5
+  two boo
+  three
+  bour
+  five
+  six boo
+  $ gr -n foo
+  file
+  input
+
+Lines longer than read buffer (1MB) are searched in pieces, matches on their
+boundaries are not lost:
+
+  $ head -c 1048574 /dev/zero | tr '\0' x > long
+  $ printf 'foo' >> long
+  $ head -c 2000000 /dev/zero | tr '\0' y >> long
+  $ printf 'foo\nbar foo\n' >> long
+  $ gr --json foo - < long | grep -o '"column":[0-9]*'
+  "column":1048575
+  "column":3048578
+  "column":5
+  $ gr foo -r BAR - < long | grep -o 'foo\|BAR'
+  BAR
+  BAR
+  BAR
+  $ head -c 1044479 /dev/zero | tr '\0' x > long
+  $ printf 'bbcbbcbbc' >> long
+  $ head -c 1048576 /dev/zero | tr '\0' y >> long
+  $ echo >> long
+  $ gr --json 'b[a-c]{0,3}c' - < long | grep -o '"column":[0-9]*'
+  "column":1044480
+  "column":1044483
+  "column":1044486
+  $ gr 'b[a-c]{0,3}c' -r '<$0>' - < long | grep -o '<[a-c]*>'
+  <bbc>
+  <bbc>
+  <bbc>
+  $ rm long
+  $ cd ..
+
+Check that big files are searched line by line, or read whole with -B:
+
+  $ mkdir big && cd big
+  $ printf 'one\ntwo test\nthree\nfour test\n' > big
+  $ echo test > small
+  $ gr -b 10 -A1 test
+  Searching big line by line, too big: 29B
+  
+  big
+  2:two test
+  3-three
+  4:four test
+  
+  small
+  1:test
+  $ gr -b 10 '^four' big
+  Searching big line by line, too big: 29B
+  
+  big
+  4:four test
+  $ gr -b 10 -B '^four' big
+  $ gr -b 10 -B '^one\ntwo' big
+  big
+  1:one
+  two test
+  $ gr -b 10 test -r x
+  Skipping big, too big: 29B
+  
+  small
+    - test
+    + x
+    1 change
+  $ cat big
+  one
+  two test
+  three
+  four test
+  $ gr --explain big -b 10 | grep big:
+    big:      yes (29B, limit is 10B), searched line by line
+  $ gr --explain big -b 10 -r x | grep big:
+    big:      yes (29B, limit is 10B), can't replace in it
+  $ gr --explain big -b 10 -B -r x | grep big:
+    big:      yes (29B, limit is 10B), read whole (-B)
+  $ gr -b 10 -B test -r x
+  big
+    - test
+    + x
+    - test
+    + x
+    2 changes
+  $ cat big
+  one
+  two x
+  three
+  four x
+  $ cd ..
+
+Check searching for several patterns:
+
+  $ mkdir patterns && cd patterns
+  $ printf 'foo(1) bar baz\nqux foo\n' > a
+  $ printf 'ba(r|z)\n\nq(u)x\n' > pats
+  $ gr -e 'fo(o)' -F pats
+  a
+  1:foo(1) bar baz
+  2:qux foo
+  $ gr --json -e 'fo(o)' -F pats | grep '"match"' | head -n 2
+  {"type":"match","path":"a","line":1,"column":1,"start":0,"end":3,"text":"foo","line_text":"foo(1) bar baz","submatches":[{"start":2,"end":3,"text":"o"}],"pattern":0}
+  {"type":"match","path":"a","line":1,"column":8,"start":7,"end":10,"text":"bar","line_text":"foo(1) bar baz","submatches":[{"start":9,"end":10,"text":"r"}],"pattern":1}
+  $ gr -e foo -e bar -r x -r y -r z
+  Got 3 replacements for 2 patterns, give either one for all of them or one for each
+  [1]
+  $ gr -e 'fo(o)' -e 'ba(r)' -r 'F$1' -r 'B$1' > /dev/null
+  $ cat a
+  Fo(1) Br baz
+  qux Fo
+  $ gr -e Fo -e baz -r X > /dev/null
+  $ cat a
+  X(1) Br X
+  qux X
+  $ cd ..
+
+Check inverted search and files without matches:
+
+  $ mkdir invert && cd invert
+  $ printf '// Copyright\npackage a\n' > a.go
+  $ printf 'package b\nfunc x() {}\n' > b.go
+  $ printf 'package c\n' > c.go
+  $ echo Copyright > notes.txt
+  $ gr -L Copyright
+  b.go
+  c.go
+  $ gr -L Copyright -t go -g '!c.go'
+  b.go
+  $ gr -L Copyright -t go *
+  b.go
+  c.go
+  $ gr --invert-match package -t go
+  a.go
+  1:// Copyright
+  
+  b.go
+  2:func x() {}
+  $ gr --invert-match -N -C1 package b.go
+  b.go-1-package b
+  b.go:2:func x() {}
+  $ gr -B -b 1 -L Copyright
+  b.go
+  c.go
+  $ gr -L -f '^[ab]' -t go
+  c.go
+  $ cat b.go | gr --invert-match func -
+  <stdin>
+  1:package b
+  $ gr --invert-match package -r x
+  Can't replace with --invert-match or --files-without-match
+  [1]
+  $ cd ..
+
+Check that files given explicitly skip ignore files, but not filters:
+
+  $ mkdir explicit && cd explicit
+  $ mkdir .git
+  $ echo 'a.*' > .gitignore
+  $ echo hello > a.txt && echo hello > a.go
+  $ gr -n hello
+  $ gr -n hello a.txt a.go
+  a.txt
+  a.go
+  $ gr -n -t go hello a.txt a.go
+  a.go
+  $ gr -n -g '!*.txt' hello a.txt a.go
+  a.go
+  $ gr -n -x 'txt$' hello a.txt a.go
+  a.go
+  $ gr -n -o 'txt$' hello a.txt a.go
+  a.txt
+  $ gr -n -x 'txt$' --no-layer exclude hello a.txt a.go
+  a.txt
+  a.go
+  $ cd ..
+
+Check filtering by globs:
+
+  $ mkdir globs && cd globs
+  $ mkdir -p src/vendor docs
+  $ echo test > src/main.go
+  $ echo test > src/main_test.go
+  $ echo test > src/vendor/lib.go
+  $ echo test > src/README.MD
+  $ echo test > docs/index.md
+  $ gr -n test -g '*.go'
+  src/main.go
+  src/main_test.go
+  src/vendor/lib.go
+  $ gr -n test -g '*.go' -g '!*_test.go' -g '!vendor/'
+  src/main.go
+  $ gr -n test -g '!src/*' -g 'src/main*'
+  src/main.go
+  src/main_test.go
+  $ gr -n test -g '*.md'
+  docs/index.md
+  $ gr -n test -g '*.md' --glob-case-insensitive
+  docs/index.md
+  src/README.MD
+  $ cd src && gr --explain main_test.go -g '*.go' -g '!*_test.go' | grep glob:
+    glob:     ignored (-g !*_test.go)
+  $ cd ../..
+
+Check filtering by file types:
+
+  $ mkdir types && cd types
+  $ echo test > main.go
+  $ echo test > app.js
+  $ echo test > Makefile
+  $ printf '#!/usr/bin/env python3\ntest\n' > script
+  $ printf '#!/bin/sh\ntest\n' > run
+  $ echo test > notes
+  $ gr -n test -t go -t make
+  Makefile
+  main.go
+  $ gr -n test -t py -t sh
+  run
+  script
+  $ gr -n test -T js -T py
+  Makefile
+  main.go
+  notes
+  run
+  $ gr -n test -t proto --type-add 'proto:*.proto' --type-add 'proto:notes'
+  notes
+  $ gr -n test -t nope
+  unknown type 'nope', see --type-list
+  [1]
+  $ gr --type-list --type-add 'proto:*.proto,#!protoc' | grep -E '^(go|proto|py):'
+  go: *.go
+  proto: *.proto, #!protoc
+  py: *.py, *.pyi, #!python, #!python2, #!python3
+  $ gr --explain script -t py | grep type:
+    type:     not ignored (-t py (#!python3))
+  $ gr --explain app.js -t go -T js | grep type:
+    type:     ignored (-T js (*.js))
+  $ cd ..
+
+Check that options are read from config files and environment:
+
+  $ mkdir -p config/xdg/gr config/project/sub && cd config
+  $ export XDG_CONFIG_HOME=$PWD/xdg
+  $ printf -- '# exclude a\n--exclude=^a\n--no-stdin\n' > xdg/gr/config
+  $ printf -- '-x\n^b\n' > project/.grrc
+  $ cd project/sub
+  $ echo test > a1 && echo test > b1 && echo test > c1
+  $ gr -n test
+  c1
+  $ GR_OPTS=-N gr test
+  c1:1:test
+  $ gr -n --no-config test < /dev/null
+  a1
+  b1
+  c1
+  $ GR_OPTS='-b 2M' gr --print-config -b 1M -x '^d'
+  --exclude=^a                   */config/xdg/gr/config (glob)
+  --no-stdin                     */config/xdg/gr/config (glob)
+  --exclude=^b                   */config/project/.grrc (glob)
+  --exclude=^d                   command line
+  --big-file=1M                  command line
+  --no-colors                    command line
+  $ GR_OPTS='-x "c 1" -x '"'"'d 1'"'"' -x e\ 1' gr --print-config
+  --exclude=^a                   */config/xdg/gr/config (glob)
+  --no-stdin                     */config/xdg/gr/config (glob)
+  --exclude=^b                   */config/project/.grrc (glob)
+  --exclude=c 1                  GR_OPTS
+  --exclude=d 1                  GR_OPTS
+  --exclude=e 1                  GR_OPTS
+  --no-colors                    command line
+  $ GR_OPTS='-x "c1' gr test
+  GR_OPTS: unterminated quote or escape in '-x "c1'
+  [1]
+  $ echo test > ../.grrc
+  $ gr test
+  */config/project/.grrc: only options can be given, not 'test' (glob)
+  [1]
+
+.grrc can come with any repository, so it can't change files:
+
+  $ printf -- '-r\nPWNED\n' > ../.grrc
+  $ gr test
+  */config/project/.grrc: option --replace can't be set in .grrc, only search and display options are allowed there (glob)
+  [1]
+  $ cat c1
+  test
+  $ printf -- '--undo\n' > ../.grrc
+  $ gr test
+  */config/project/.grrc: option --undo can't be set in .grrc, only search and display options are allowed there (glob)
+  [1]
+  $ printf -- '--type-add=t:*1\n-t\nt\n-x\n^a\n' > ../.grrc
+  $ gr -n test
+  b1
+  c1
+  $ rm ../.grrc
+  $ mkdir -p home/.config/gr && echo --no-group > home/.config/gr/config
+  $ (export HOME=$PWD/home XDG_CONFIG_HOME=; gr --print-config --no-stdin)
+  --no-group                     */home/.config/gr/config (glob)
+  --no-colors                    command line
+  --no-stdin                     command line
+  $ rm -r home
+  $ export XDG_CONFIG_HOME=$START_DIR/.xdg
+  $ cd ../../..
+
 Check that .* matches only files starting with dot:
 
   $ mkdir dotstar && cd dotstar
@@ -103,10 +873,11 @@ Check that a dry run can be executed:
   $ gr 'a.c' --replace 'cba' --dry-run
   Searching for: a.c
   Replacing with: cba
-  a.txt
-    - adc
-    + cba
-    1 change
+  --- a.txt
+  +++ a.txt
+  @@ -1,1 +1,1 @@
+  -adc
+  +cba
   $ cat a.txt
   adc
   $ cat b.txt
@@ -140,3 +911,137 @@ Check that a find/replace executes correctly:
   xyz
   $ cd ..
 
+
+Check that replacements keep file mode and write through links:
+
+  $ mkdir links && cd links
+  $ echo abc > real
+  $ chmod 600 real
+  $ ln -s real sym
+  $ gr abc -r def -o sym
+  sym
+    - abc
+    + def
+    1 change
+  $ cat real
+  def
+  $ ls -l real | cut -c1-10
+  -rw-------
+  $ gr def -r ghi -o sym --links replace > /dev/null
+  $ cat real sym
+  def
+  ghi
+  $ test -L sym || echo "not a link"
+  not a link
+  $ cd ..
+
+Check that backups are made and not overwritten:
+
+  $ mkdir backup && cd backup
+  $ mkdir sub
+  $ echo abc > sub/one
+  $ gr abc -r def --backup --backup-dir=.bak > /dev/null
+  $ cat sub/one .bak/sub/one~
+  def
+  abc
+  $ gr def -r ghi --backup --backup-dir=.bak > /dev/null
+  Error making backup of 'sub/one', skipping: backup '.bak/sub/one~' already exists, supply --backup-overwrite to overwrite it
+  $ cat sub/one
+  def
+  $ gr def -r ghi --backup=.orig > /dev/null
+  $ cat sub/one sub/one.orig
+  ghi
+  def
+  $ cd ..
+
+Check that diff can be applied as a patch:
+
+  $ mkdir diff && cd diff
+  $ printf 'one\ntwo\nthree\nfour\nfive\nsix\n' > a
+  $ gr 'two|five' -r 2 --diff -U 1 --dry-run > ../diff.patch
+  $ cat ../diff.patch
+  Searching for: two|five
+  Replacing with: 2
+  --- a
+  +++ a
+  @@ -1,6 +1,6 @@
+   one
+  -two
+  +2
+   three
+   four
+  -five
+  +2
+   six
+  $ patch -p0 < ../diff.patch
+  patching file a
+  $ cat a
+  one
+  2
+  three
+  four
+  2
+  six
+
+Zero-width matches (of \b here) get valid hunks too:
+
+  $ printf 'ab\ncd' > b
+  $ gr -e 'b\n' -e '\b' -r '|' --diff -U 0 --dry-run b > ../diff.patch
+  $ cat ../diff.patch
+  Searching for: b\n, \b
+  Replacing with: |
+  --- b
+  +++ b
+  @@ -1,2 +1,1 @@
+  -ab
+  -cd
+  \ No newline at end of file
+  +|a|cd|
+  \ No newline at end of file
+  $ patch -p0 < ../diff.patch
+  patching file b
+  $ cat b
+  |a|cd| (no-eol)
+
+Replacing newline joins the next line, which is changed too:
+
+  $ printf 'one\nfoo\nbar\nbaz\n' > c
+  $ gr 'foo\n' -r X --diff -U 0 --dry-run c > ../diff.patch
+  $ cat ../diff.patch
+  Searching for: foo\n
+  Replacing with: X
+  --- c
+  +++ c
+  @@ -2,2 +2,1 @@
+  -foo
+  -bar
+  +Xbar
+  $ patch -p0 < ../diff.patch
+  patching file c
+  $ cat c
+  one
+  Xbar
+  baz
+  $ cd ..
+
+Check that replacements can be undone:
+
+  $ mkdir undo && cd undo
+  $ export XDG_CACHE_HOME=$PWD/../undo-cache
+  $ echo abc > one
+  $ echo abc > two
+  $ gr abc -r def > /dev/null
+  $ echo changed > two
+  $ gr --undo
+  Restored */undo/one (glob)
+  Not restoring */undo/two: file was changed since replacement (glob)
+  Some files were not restored
+  [1]
+  $ cat one two
+  abc
+  changed
+  $ gr --undo
+  Not restoring */undo/two: file was changed since replacement (glob)
+  Some files were not restored
+  [1]
+  $ cd ..
@@ -0,0 +1,234 @@
+// (c) 2011-2014 Alexander Solovyov
+// under terms of ISC license
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// FileType is a named set of globs, which match file names, and interpreters
+// of scripts without extension, recognized by their shebang line
+type FileType struct {
+	name         string
+	globs        []string
+	interpreters []string
+}
+
+func (t *FileType) String() string {
+	parts := append([]string{}, t.globs...)
+	for _, interp := range t.interpreters {
+		parts = append(parts, "#!"+interp)
+	}
+	return t.name + ": " + strings.Join(parts, ", ")
+}
+
+// Reports if file fn is of this type, with shebang being interpreter of fn or
+// empty string, and returns what matched
+func (t *FileType) match(fn string, shebang string) (bool, string) {
+	base := filepath.Base(fn)
+	for _, glob := range t.globs {
+		if Wildmatch(glob, base, false) {
+			return true, glob
+		}
+	}
+	for _, interp := range t.interpreters {
+		if shebang == interp {
+			return true, "#!" + interp
+		}
+	}
+	return false, ""
+}
+
+// known types by name, more can be added with --type-add
+var fileTypes = map[string]*FileType{}
+
+func init() {
+	// entries are globs, except ones starting with "#!", which are interpreters
+	for _, def := range []string{
+		"c:*.c,*.h",
+		"clojure:*.clj,*.cljs,*.cljc,*.edn",
+		"cpp:*.cpp,*.cc,*.cxx,*.hpp,*.hh,*.hxx,*.h",
+		"css:*.css,*.scss,*.sass,*.less",
+		"elixir:*.ex,*.exs",
+		"erlang:*.erl,*.hrl",
+		"go:*.go",
+		"haskell:*.hs,*.lhs",
+		"html:*.html,*.htm,*.xhtml",
+		"java:*.java",
+		"js:*.js,*.jsx,*.mjs,*.cjs,#!node",
+		"json:*.json",
+		"lua:*.lua,#!lua",
+		"make:Makefile,makefile,GNUmakefile,*.mk,*.mak",
+		"md:*.md,*.markdown",
+		"perl:*.pl,*.pm,*.t,#!perl",
+		"php:*.php,#!php",
+		"py:*.py,*.pyi,#!python,#!python2,#!python3",
+		"rb:*.rb,Gemfile,Rakefile,*.gemspec,#!ruby",
+		"rust:*.rs",
+		"sh:*.sh,*.bash,*.zsh,#!sh,#!bash,#!zsh,#!dash,#!ksh",
+		"sql:*.sql",
+		"ts:*.ts,*.tsx",
+		"txt:*.txt",
+		"xml:*.xml,*.xsd,*.xsl",
+		"yaml:*.yaml,*.yml",
+	} {
+		errhandle(AddFileType(def), true)
+	}
+}
+
+// AddFileType adds globs and interpreters to a type, creating it if needed;
+// def looks like "name:glob,glob,#!interpreter"
+func AddFileType(def string) error {
+	colon := strings.IndexByte(def, ':')
+	if colon < 1 || colon == len(def)-1 {
+		return fmt.Errorf("invalid type definition '%s', should be NAME:GLOB[,GLOB...]",
+			def)
+	}
+
+	name := def[:colon]
+	t, ok := fileTypes[name]
+	if !ok {
+		t = &FileType{name: name}
+		fileTypes[name] = t
+	}
+	for _, entry := range strings.Split(def[colon+1:], ",") {
+		switch {
+		case entry == "":
+		case strings.HasPrefix(entry, "#!"):
+			t.interpreters = append(t.interpreters, entry[2:])
+		default:
+			t.globs = append(t.globs, entry)
+		}
+	}
+	return nil
+}
+
+func printFileTypes() {
+	names := make([]string, 0, len(fileTypes))
+	for name := range fileTypes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Println(fileTypes[name])
+	}
+}
+
+// TypeMatcher ignores files, which are not of any type given with -t, or are
+// of a type given with -T
+type TypeMatcher struct {
+	only    []*FileType
+	exclude []*FileType
+}
+
+func NewTypeMatcher(only []string, exclude []string) *TypeMatcher {
+	m := &TypeMatcher{}
+	for _, name := range only {
+		m.only = append(m.only, lookupFileType(name))
+	}
+	for _, name := range exclude {
+		m.exclude = append(m.exclude, lookupFileType(name))
+	}
+	return m
+}
+
+func lookupFileType(name string) *FileType {
+	t, ok := fileTypes[name]
+	if !ok {
+		errhandle(fmt.Errorf("unknown type '%s', see --type-list", name), true)
+	}
+	return t
+}
+
+func (m *TypeMatcher) String() string {
+	var descs []string
+	if len(m.only) > 0 {
+		descs = append(descs, "Searching only files of types"+typeNames(m.only))
+	}
+	if len(m.exclude) > 0 {
+		descs = append(descs, "Ignoring files of types"+typeNames(m.exclude))
+	}
+	return strings.Join(descs, "\n")
+}
+
+func typeNames(types []*FileType) (names string) {
+	for _, t := range types {
+		names += " " + t.name
+	}
+	return names
+}
+
+func (m *TypeMatcher) Match(fn string, isdir bool) bool {
+	ignored, _ := m.Explain(fn, isdir)
+	return ignored
+}
+
+func (m *TypeMatcher) Explain(fn string, isdir bool) (bool, string) {
+	if isdir || (len(m.only) == 0 && len(m.exclude) == 0) {
+		return false, ""
+	}
+
+	shebang := ""
+	if !strings.Contains(filepath.Base(fn), ".") {
+		shebang = readShebang(fn)
+	}
+
+	for _, t := range m.exclude {
+		if ok, what := t.match(fn, shebang); ok {
+			return true, fmt.Sprintf("-T %s (%s)", t.name, what)
+		}
+	}
+
+	if len(m.only) == 0 {
+		return false, ""
+	}
+	for _, t := range m.only {
+		if ok, what := t.match(fn, shebang); ok {
+			return false, fmt.Sprintf("-t %s (%s)", t.name, what)
+		}
+	}
+	return true, "not of any -t type"
+}
+
+// Returns name of interpreter from the first line of a script (like "python"
+// for "#!/usr/bin/env python"), or empty string
+func readShebang(fn string) string {
+	f, err := os.Open(fn)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+
+	head := make([]byte, 128)
+	n, _ := f.Read(head)
+	head = head[:n]
+	if !bytes.HasPrefix(head, []byte("#!")) {
+		return ""
+	}
+	if end := bytes.IndexByte(head, '\n'); end != -1 {
+		head = head[:end]
+	}
+
+	fields := strings.Fields(string(head[2:]))
+	if len(fields) == 0 {
+		return ""
+	}
+	interp := filepath.Base(fields[0])
+	if interp == "env" {
+		// skip options of env, like -S
+		interp = ""
+		for _, field := range fields[1:] {
+			if !strings.HasPrefix(field, "-") {
+				interp = filepath.Base(field)
+				break
+			}
+		}
+	}
+	return interp
+}
@@ -4,27 +4,82 @@
 package main
 
 import (
+	"bytes"
 	"fmt"
+	"io"
+	"strconv"
+
 	"github.com/wsxiaoys/terminal/color"
 )
 
-type Printer struct {
-	NoColors bool
-	NoGroup  bool
-	previous string
+// Printer receives everything gr finds or changes and decides how to show
+// it. Every file gets its own Printer (see Fork), since files are processed
+// concurrently.
+type Printer interface {
+	// Fork returns a printer for a single file, writing to out
+	Fork(out io.Writer) Printer
+	// Grouped reports if file name was printed as a header of a group
+	Grouped() bool
+
+	// Notice is a human-readable message, not related to any file
+	Notice(colorfmt, plainfmt string, args ...interface{})
+	// Begin is called before first Match or Context of a file, maxLine is
+	// the biggest line number which is going to be printed
+	Begin(fn string, maxLine int)
+	Match(fn string, info *LineInfo)
+	Context(fn string, num int, line []byte)
+	// Break separates non-contiguous groups of lines
+	Break(fn string)
+	BinaryMatch(fn string)
+	// FileName is called for matching files when only names are printed
+	FileName(fn string)
+	// FoundName is called for file names matching pattern (--find-files)
+	FoundName(fn string, matches [][]int)
+	Replace(fn string, r *Replacement)
+	// Diff is called with unified diff of all replacements in a file
+	Diff(fn string, diff []byte)
+	// End is called for every processed file
+	End(fn string, stats *FileStats)
+	// Summary is called once, after all files were processed
+	Summary()
 }
 
-func (p *Printer) Printf(colorfmt, plainfmt string,
+type FileStats struct {
+	Matches      int
+	Lines        int
+	Replacements int
+}
+
+type Replacement struct {
+	num    int
+	column int
+	start  int
+	end    int
+	before []byte
+	after  []byte
+}
+
+type TextPrinter struct {
+	NoColors  bool
+	NoGroup   bool
+	ShowDiff  bool
+	previous  string
+	out       io.Writer
+	idxFmt    string
+	replacing string
+}
+
+func (p *TextPrinter) Printf(colorfmt, plainfmt string,
 	args ...interface{}) {
 
 	if p.NoColors {
-		fmt.Printf(plainfmt, args...)
+		fmt.Fprintf(p.out, plainfmt, args...)
 	} else {
-		color.Printf(colorfmt, args...)
+		color.Fprintf(p.out, colorfmt, args...)
 	}
 }
 
-func (p *Printer) Sprintf(colorfmt, plainfmt string,
+func (p *TextPrinter) Sprintf(colorfmt, plainfmt string,
 	args ...interface{}) string {
 
 	if p.NoColors {
@@ -34,14 +89,28 @@ func (p *Printer) Sprintf(colorfmt, plainfmt string,
 	}
 }
 
-func (p *Printer) FilePrintf(fn, colorfmt, plainfmt string,
+func (p *TextPrinter) FilePrintf(fn, colorfmt, plainfmt string,
+	args ...interface{}) {
+
+	p.filePrintf(fn, ":", colorfmt, plainfmt, args...)
+}
+
+// same as FilePrintf, but for context lines, which are marked with "-"
+// instead of ":" when file name is printed before each line
+func (p *TextPrinter) FileContextPrintf(fn, colorfmt, plainfmt string,
+	args ...interface{}) {
+
+	p.filePrintf(fn, "-", colorfmt, plainfmt, args...)
+}
+
+func (p *TextPrinter) filePrintf(fn, sep, colorfmt, plainfmt string,
 	args ...interface{}) {
 
 	if p.NoGroup {
-		p.Printf("@g%s:", "%s:", fn)
+		p.Printf("@g%s"+sep, "%s"+sep, fn)
 	} else if fn != p.previous {
 		if p.previous != "" {
-			fmt.Println("")
+			fmt.Fprintln(p.out, "")
 		}
 		p.Printf("@g%s\n", "%s\n", fn)
 		p.previous = fn
@@ -49,3 +118,130 @@ func (p *Printer) FilePrintf(fn, colorfmt, plainfmt string,
 
 	p.Printf(colorfmt, plainfmt, args...)
 }
+
+// colors of matches of every pattern, when there are several of them
+var highlightColors = []string{"@Y", "@C", "@M", "@G", "@B", "@R"}
+
+// Highlights matches in s, which starts at offset in the original content,
+// with which telling their patterns (if there are several)
+func (p *TextPrinter) highlight(s []byte, offset int, matches [][]int,
+	which []int) string {
+
+	if p.NoColors {
+		return string(s)
+	}
+
+	res, last := "", 0
+	for i, m := range matches {
+		start, end := m[0]-offset, m[1]-offset
+		if start < last {
+			start = last
+		}
+		if end > len(s) {
+			end = len(s)
+		}
+		if start >= end {
+			continue
+		}
+		color := highlightColors[0]
+		if which != nil {
+			color = highlightColors[which[i]%len(highlightColors)]
+		}
+		res += string(s[last:start]) + p.Sprintf(color+"%s", "%s", s[start:end])
+		last = end
+	}
+	return res + string(s[last:])
+}
+
+func (p *TextPrinter) Fork(out io.Writer) Printer {
+	return &TextPrinter{NoColors: p.NoColors, NoGroup: p.NoGroup,
+		ShowDiff: p.ShowDiff, out: out}
+}
+
+func (p *TextPrinter) Grouped() bool {
+	return p.previous != ""
+}
+
+func (p *TextPrinter) Notice(colorfmt, plainfmt string, args ...interface{}) {
+	p.Printf(colorfmt, plainfmt, args...)
+}
+
+func (p *TextPrinter) Begin(fn string, maxLine int) {
+	if p.NoGroup {
+		p.idxFmt = "%d"
+	} else {
+		p.idxFmt = fmt.Sprintf("%%%dd", len(strconv.Itoa(maxLine)))
+	}
+}
+
+func (p *TextPrinter) Match(fn string, info *LineInfo) {
+	p.FilePrintf(fn,
+		"@!@y"+p.idxFmt+":@|%s\n",
+		p.idxFmt+":%s\n",
+		info.num,
+		p.highlight(info.line, info.begin, info.matches, info.which))
+}
+
+func (p *TextPrinter) Context(fn string, num int, line []byte) {
+	p.FileContextPrintf(fn,
+		"@y"+p.idxFmt+"-@|%s\n",
+		p.idxFmt+"-%s\n",
+		num,
+		line)
+}
+
+func (p *TextPrinter) Break(fn string) {
+	p.Printf("@c--\n", "--\n")
+}
+
+func (p *TextPrinter) BinaryMatch(fn string) {
+	p.Printf("Binary file '%s' matches\n", "Binary file '%s' matches\n", fn)
+}
+
+func (p *TextPrinter) FileName(fn string) {
+	p.Printf("@g%s\n", "%s\n", fn)
+}
+
+func (p *TextPrinter) FoundName(fn string, matches [][]int) {
+	p.Printf("%s\n", "%s\n", p.highlight([]byte(fn), 0, matches, nil))
+}
+
+func (p *TextPrinter) Replace(fn string, r *Replacement) {
+	if p.ShowDiff {
+		return
+	}
+
+	if fn != p.replacing {
+		p.Printf("@g%s\n", "%s\n", fn)
+		p.replacing = fn
+	}
+	p.Printf("@g  - %s\n", "  - %s\n", r.before)
+	p.Printf("@g  + %s\n", "  + %s\n", r.after)
+}
+
+func (p *TextPrinter) Diff(fn string, diff []byte) {
+	for _, line := range splitLines(diff) {
+		switch {
+		case bytes.HasPrefix(line, []byte("---")), bytes.HasPrefix(line, []byte("+++")):
+			p.Printf("@!%s", "%s", line)
+		case bytes.HasPrefix(line, []byte("@@")):
+			p.Printf("@c%s", "%s", line)
+		case line[0] == '-':
+			p.Printf("@r%s", "%s", line)
+		case line[0] == '+':
+			p.Printf("@g%s", "%s", line)
+		default:
+			p.Printf("%s", "%s", line)
+		}
+	}
+}
+
+func (p *TextPrinter) End(fn string, stats *FileStats) {
+	if stats.Replacements > 0 && !p.ShowDiff {
+		p.Printf("@!@y  %d change%s\n", "  %d change%s\n",
+			stats.Replacements, getSuffix(stats.Replacements))
+	}
+}
+
+func (p *TextPrinter) Summary() {
+}
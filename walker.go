@@ -0,0 +1,243 @@
+// (c) 2011-2014 Alexander Solovyov
+// under terms of ISC license
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// returned from walk function to stop walking when user asked to quit
+var errQuit = errors.New("quit")
+
+// file found by walker, seq is used to restore walk order in output
+type fileJob struct {
+	seq int
+	fn  string
+	fi  os.FileInfo
+}
+
+// file or directory to search, as given by user
+type searchRoot struct {
+	path    string
+	matcher *MatcherStack
+}
+
+// Makes roots from paths, directories get matchers of their repositories,
+// while files given explicitly are checked only against filters given by
+// user (-x, -o, -g, -t). Matcher for current directory is reused, if given.
+func NewSearchRoots(paths []string, cwdMatcher *MatcherStack,
+	disabled map[string]bool) []*searchRoot {
+
+	roots := []*searchRoot{}
+	for _, path := range paths {
+		if path == stdinPath {
+			roots = append(roots, &searchRoot{path, nil})
+			continue
+		}
+
+		fi, err := os.Stat(path)
+		if err != nil {
+			errhandle(err, false)
+			continue
+		}
+
+		matcher := cwdMatcher
+		if cwdMatcher == nil || !fi.IsDir() || filepath.Clean(path) != "." {
+			matcher = newRootMatcher(path, fi.IsDir(), disabled)
+		}
+		roots = append(roots, &searchRoot{path, matcher})
+	}
+	return roots
+}
+
+func newRootMatcher(path string, isdir bool, disabled map[string]bool) *MatcherStack {
+	root := path
+	if !isdir {
+		root = "."
+		fileDisabled := map[string]bool{"general": true, "vcs": true,
+			"project": true}
+		for _, name := range []string{"exclude", "only", "glob", "type"} {
+			fileDisabled[name] = disabled[name]
+		}
+		disabled = fileDisabled
+	}
+	return NewMatcherStack(root, disabled, opts.IgnoreFiles, opts.AcceptFiles,
+		NewGlobMatcher(opts.Globs, opts.GlobCaseFold),
+		NewTypeMatcher(opts.Types, opts.NotTypes))
+}
+
+// Walk is like filepath.Walk, but passes paths starting with root as it was
+// given (and follows root if it's a symlink to a directory)
+func (r *searchRoot) Walk(walkFn filepath.WalkFunc) error {
+	root := filepath.Clean(r.path)
+	walkroot := root
+	if fi, err := os.Lstat(root); err == nil && fi.Mode()&os.ModeSymlink != 0 {
+		walkroot += string(filepath.Separator)
+	}
+
+	return filepath.Walk(walkroot, func(fn string, fi os.FileInfo, err error) error {
+		if rel, relerr := filepath.Rel(root, fn); relerr == nil {
+			fn = r.shown(fn, rel)
+		}
+		return walkFn(fn, fi, err)
+	})
+}
+
+// Returns path fn, which is rel relative to root, in the form it's printed:
+// starting with root as it was given
+func (r *searchRoot) shown(fn string, rel string) string {
+	switch {
+	case r.path == ".":
+		return fn
+	case rel == ".":
+		return r.path
+	case strings.HasSuffix(r.path, string(filepath.Separator)):
+		return r.path + rel
+	}
+	return r.path + string(filepath.Separator) + rel
+}
+
+// output of a single file, buffered until it's this file's turn to be printed
+type fileResult struct {
+	seq     int
+	out     bytes.Buffer
+	grouped bool
+	flushed chan bool
+}
+
+// Walks directories in a single goroutine (ignore matchers are not safe for
+// concurrent use), feeds files to a pool of workers, which read and match
+// them, and prints results in walk order (or as soon as they are ready, if
+// ordering is not required). Groups of lines are separated from the ones
+// printed before, if grouped is set, and it returns if there are any groups
+// printed after it.
+func (v *GRVisitor) Run(roots []*searchRoot, jobs int, ordered bool,
+	out io.Writer, grouped bool) (bool, error) {
+
+	if jobs < 1 {
+		jobs = 1
+	}
+
+	files := make(chan *fileJob, jobs*4)
+	results := make(chan *fileResult, jobs*4)
+	walkerr := make(chan error, 1)
+
+	go func() {
+		seq := 0
+		// copy of visitor with matcher of current root
+		var rv GRVisitor
+		walk := func(fn string, fi os.FileInfo, err error) error {
+			if err != nil {
+				if opts.Verbose {
+					errhandle(err, false)
+				}
+				return nil
+			}
+
+			if fi.IsDir() {
+				if !rv.VisitDir(fn, fi) {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+
+			if rv.prompter != nil && rv.prompter.Quit() {
+				return errQuit
+			}
+
+			if rv.AcceptFile(fn, fi) {
+				files <- &fileJob{seq, fn, fi}
+				seq++
+			}
+			return nil
+		}
+
+		var err error
+		for _, root := range roots {
+			rv = *v
+			rv.ignoreFileMatcher = root.matcher
+			if err = root.Walk(walk); err != nil {
+				break
+			}
+		}
+		walkerr <- err
+		close(files)
+	}()
+
+	done := make(chan bool)
+	for i := 0; i < jobs; i++ {
+		go v.worker(files, results, done)
+	}
+	go func() {
+		for i := 0; i < jobs; i++ {
+			<-done
+		}
+		close(results)
+	}()
+
+	flush := func(res *fileResult) {
+		if res.flushed != nil {
+			defer close(res.flushed)
+		}
+		if res.out.Len() == 0 {
+			return
+		}
+		if res.grouped && grouped {
+			io.WriteString(out, "\n")
+		}
+		grouped = grouped || res.grouped
+		out.Write(res.out.Bytes())
+	}
+
+	next := 0
+	pending := make(map[int]*fileResult)
+	for res := range results {
+		if !ordered {
+			flush(res)
+			continue
+		}
+
+		pending[res.seq] = res
+		for r, ok := pending[next]; ok; r, ok = pending[next] {
+			delete(pending, next)
+			flush(r)
+			next++
+		}
+	}
+
+	err := <-walkerr
+	if err == errQuit {
+		return grouped, nil
+	}
+	return grouped, err
+}
+
+// Every worker has its own copy of visitor, which gets a new printer for
+// every file, writing to file's buffer.
+func (v *GRVisitor) worker(files <-chan *fileJob, results chan<- *fileResult,
+	done chan<- bool) {
+
+	w := *v
+	for job := range files {
+		res := &fileResult{seq: job.seq}
+		w.printer = v.printer.Fork(&res.out)
+		w.VisitFile(job.fn, job.fi)
+		res.grouped = w.printer.Grouped()
+
+		// don't ask next question until output for this file is printed
+		if v.prompter != nil {
+			res.flushed = make(chan bool)
+			results <- res
+			<-res.flushed
+		} else {
+			results <- res
+		}
+	}
+	done <- true
+}
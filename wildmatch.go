@@ -0,0 +1,309 @@
+// (c) 2011-2014 Alexander Solovyov
+// under terms of ISC license
+
+package main
+
+// Port of git's wildmatch.c, which implements shell glob matching the way
+// git does it for .gitignore: '*' and '?' never match '/', while '**'
+// between slashes (or at the beginning or end of the pattern) matches any
+// number of directories.
+
+const (
+	wmMatch = iota
+	wmNoMatch
+	wmAbortAll
+	wmAbortToStarStar
+)
+
+func wmAt(s string, i int) byte {
+	if i < len(s) {
+		return s[i]
+	}
+	return 0
+}
+
+func wmLower(c byte) byte {
+	if 'A' <= c && c <= 'Z' {
+		return c + 'a' - 'A'
+	}
+	return c
+}
+
+func wmUpper(c byte) byte {
+	if 'a' <= c && c <= 'z' {
+		return c - 'a' + 'A'
+	}
+	return c
+}
+
+func isGlobSpecial(c byte) bool {
+	return c == '*' || c == '?' || c == '[' || c == '\\'
+}
+
+// Wildmatch reports if text matches glob pattern, with '/' being special
+// (like fnmatch with FNM_PATHNAME, plus support of '**')
+func Wildmatch(pattern, text string, casefold bool) bool {
+	return dowild(pattern, 0, text, 0, casefold) == wmMatch
+}
+
+func dowild(p string, pi int, text string, ti int, casefold bool) int {
+	for ; pi < len(p); ti, pi = ti+1, pi+1 {
+		pch := p[pi]
+		tch := wmAt(text, ti)
+		if tch == 0 && ti >= len(text) && pch != '*' {
+			return wmAbortAll
+		}
+		if casefold {
+			tch = wmLower(tch)
+			pch = wmLower(pch)
+		}
+
+		switch pch {
+		case '\\':
+			// literal match with the following character
+			pi++
+			pch = wmAt(p, pi)
+			if casefold {
+				pch = wmLower(pch)
+			}
+			if tch != pch {
+				return wmNoMatch
+			}
+			continue
+
+		case '?':
+			// match anything but '/'
+			if tch == '/' {
+				return wmNoMatch
+			}
+			continue
+
+		case '*':
+			matchSlash := false
+			pi++
+			if wmAt(p, pi) == '*' {
+				prev := pi - 2
+				for pi++; wmAt(p, pi) == '*'; pi++ {
+				}
+				next := wmAt(p, pi)
+				if (prev < 0 || p[prev] == '/') &&
+					(pi >= len(p) || next == '/' ||
+						(next == '\\' && wmAt(p, pi+1) == '/')) {
+					// assume "**/" matches nothing and try to match the
+					// rest, so that foo/**/bar matches foo/bar
+					if next == '/' && dowild(p, pi+1, text, ti, casefold) == wmMatch {
+						return wmMatch
+					}
+					matchSlash = true
+				}
+			}
+
+			if pi >= len(p) {
+				// trailing "**" matches everything, trailing "*" only if
+				// there are no more slashes
+				if !matchSlash {
+					for i := ti; i < len(text); i++ {
+						if text[i] == '/' {
+							return wmNoMatch
+						}
+					}
+				}
+				return wmMatch
+			} else if !matchSlash && p[pi] == '/' {
+				// single asterisk followed by a slash matches the next
+				// directory
+				slash := -1
+				for i := ti; i < len(text); i++ {
+					if text[i] == '/' {
+						slash = i
+						break
+					}
+				}
+				if slash == -1 {
+					return wmNoMatch
+				}
+				// the slash is consumed by the loop
+				ti = slash
+				continue
+			}
+
+			for {
+				if ti >= len(text) {
+					break
+				}
+				// advance faster when asterisk is followed by a literal
+				if !isGlobSpecial(p[pi]) {
+					pch := p[pi]
+					if casefold {
+						pch = wmLower(pch)
+					}
+					for ; ti < len(text) && (matchSlash || text[ti] != '/'); ti++ {
+						tch = text[ti]
+						if casefold {
+							tch = wmLower(tch)
+						}
+						if tch == pch {
+							break
+						}
+					}
+					if ti >= len(text) || (!matchSlash && text[ti] == '/') {
+						if matchSlash {
+							return wmAbortAll
+						}
+						return wmAbortToStarStar
+					}
+				}
+
+				matched := dowild(p, pi, text, ti, casefold)
+				if matched != wmNoMatch {
+					if !matchSlash || matched != wmAbortToStarStar {
+						return matched
+					}
+				} else if !matchSlash && text[ti] == '/' {
+					return wmAbortToStarStar
+				}
+				ti++
+			}
+			return wmAbortAll
+
+		case '[':
+			pi++
+			pch = wmAt(p, pi)
+			if pch == '^' {
+				pch = '!'
+			}
+			negated := pch == '!'
+			if negated {
+				pi++
+				pch = wmAt(p, pi)
+			}
+
+			var prev byte
+			matched := false
+			for {
+				if pi >= len(p) {
+					return wmAbortAll
+				}
+
+				if pch == '\\' {
+					pi++
+					if pi >= len(p) {
+						return wmAbortAll
+					}
+					pch = p[pi]
+					if tch == pch {
+						matched = true
+					}
+				} else if pch == '-' && prev != 0 && pi+1 < len(p) && p[pi+1] != ']' {
+					pi++
+					pch = p[pi]
+					if pch == '\\' {
+						pi++
+						if pi >= len(p) {
+							return wmAbortAll
+						}
+						pch = p[pi]
+					}
+					if tch <= pch && tch >= prev {
+						matched = true
+					} else if casefold && 'a' <= tch && tch <= 'z' {
+						upper := wmUpper(tch)
+						if upper <= pch && upper >= prev {
+							matched = true
+						}
+					}
+					pch = 0 // so that prev is reset
+				} else if pch == '[' && wmAt(p, pi+1) == ':' {
+					start := pi + 2
+					end := start
+					for end < len(p) && p[end] != ']' {
+						end++
+					}
+					if end >= len(p) {
+						return wmAbortAll
+					}
+					if end-start-1 < 0 || p[end-1] != ':' {
+						// didn't find ":]", so treat like a normal set
+						pch = '['
+						if tch == pch {
+							matched = true
+						}
+					} else {
+						class, ok := charClass(p[start:end-1], tch, casefold)
+						if !ok {
+							return wmAbortAll
+						}
+						if class {
+							matched = true
+						}
+						pi = end
+						pch = 0
+					}
+				} else if tch == pch {
+					matched = true
+				}
+
+				prev = pch
+				pi++
+				pch = wmAt(p, pi)
+				if pi >= len(p) {
+					return wmAbortAll
+				}
+				if pch == ']' {
+					break
+				}
+			}
+
+			if matched == negated || tch == '/' {
+				return wmNoMatch
+			}
+			continue
+
+		default:
+			if tch != pch {
+				return wmNoMatch
+			}
+		}
+	}
+
+	if ti < len(text) {
+		return wmNoMatch
+	}
+	return wmMatch
+}
+
+// Reports if c belongs to POSIX character class (like "alpha"), ok is false
+// for unknown classes
+func charClass(class string, c byte, casefold bool) (matched bool, ok bool) {
+	isLower := 'a' <= c && c <= 'z'
+	isUpper := 'A' <= c && c <= 'Z'
+	isDigit := '0' <= c && c <= '9'
+
+	switch class {
+	case "alnum":
+		return isLower || isUpper || isDigit, true
+	case "alpha":
+		return isLower || isUpper, true
+	case "blank":
+		return c == ' ' || c == '\t', true
+	case "cntrl":
+		return c < 32 || c == 127, true
+	case "digit":
+		return isDigit, true
+	case "graph":
+		return c > 32 && c < 127, true
+	case "lower":
+		return isLower || (casefold && isUpper), true
+	case "print":
+		return c >= 32 && c < 127, true
+	case "punct":
+		return c > 32 && c < 127 && !isLower && !isUpper && !isDigit, true
+	case "space":
+		return c == ' ' || (c >= '\t' && c <= '\r'), true
+	case "upper":
+		return isUpper || (casefold && isLower), true
+	case "xdigit":
+		return isDigit || ('a' <= c && c <= 'f') || ('A' <= c && c <= 'F'), true
+	}
+	return false, false
+}
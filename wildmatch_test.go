@@ -0,0 +1,255 @@
+// (c) 2011-2014 Alexander Solovyov
+// under terms of ISC license
+
+package main
+
+import (
+	"testing"
+)
+
+// cases from git's t/t3070-wildmatch.sh, results are for wildmatch with
+// WM_PATHNAME and its case-insensitive variant
+var wildmatchTests = []struct {
+	match, imatch bool
+	text, pattern string
+}{
+	// basic wildmatch features
+	{true, true, "foo", "foo"},
+	{false, false, "foo", "bar"},
+	{true, true, "", ""},
+	{true, true, "foo", "???"},
+	{false, false, "foo", "??"},
+	{true, true, "foo", "*"},
+	{true, true, "foo", "f*"},
+	{false, false, "foo", "*f"},
+	{true, true, "foo", "*foo*"},
+	{true, true, "foobar", "*ob*a*r*"},
+	{true, true, "aaaaaaabababab", "*ab"},
+	{true, true, "foo*", `foo\*`},
+	{false, false, "foobar", `foo\*bar`},
+	{true, true, `f\oo`, `f\\oo`},
+	{true, true, "ball", "*[al]?"},
+	{false, false, "ten", "[ten]"},
+	{true, true, "ten", "**[!te]"},
+	{false, false, "ten", "**[!ten]"},
+	{true, true, "ten", "t[a-g]n"},
+	{false, false, "ten", "t[!a-g]n"},
+	{true, true, "ton", "t[!a-g]n"},
+	{true, true, "ton", "t[^a-g]n"},
+	{true, true, "a]b", "a[]]b"},
+	{true, true, "a-b", "a[]-]b"},
+	{true, true, "a]b", "a[]-]b"},
+	{false, false, "aab", "a[]-]b"},
+	{true, true, "aab", "a[]a-]b"},
+	{true, true, "]", "]"},
+
+	// extended slash-matching features
+	{false, false, "foo/baz/bar", "foo*bar"},
+	{false, false, "foo/baz/bar", "foo**bar"},
+	{true, true, "foobazbar", "foo**bar"},
+	{true, true, "foo/baz/bar", "foo/**/bar"},
+	{true, true, "foo/baz/bar", "foo/**/**/bar"},
+	{true, true, "foo/b/a/z/bar", "foo/**/bar"},
+	{true, true, "foo/b/a/z/bar", "foo/**/**/bar"},
+	{true, true, "foo/bar", "foo/**/bar"},
+	{true, true, "foo/bar", "foo/**/**/bar"},
+	{false, false, "foo/bar", "foo?bar"},
+	{false, false, "foo/bar", "foo[/]bar"},
+	{false, false, "foo/bar", "foo[^a-z]bar"},
+	{false, false, "foo/bar", "f[^eiu][^eiu][^eiu][^eiu][^eiu]r"},
+	{true, true, "foo-bar", "f[^eiu][^eiu][^eiu][^eiu][^eiu]r"},
+	{true, true, "foo", "**/foo"},
+	{true, true, "XXX/foo", "**/foo"},
+	{true, true, "bar/baz/foo", "**/foo"},
+	{false, false, "bar/baz/foo", "*/foo"},
+	{false, false, "foo/bar/baz", "**/bar*"},
+	{true, true, "deep/foo/bar/baz", "**/bar/*"},
+	{false, false, "deep/foo/bar/baz/", "**/bar/*"},
+	{true, true, "deep/foo/bar/baz/", "**/bar/**"},
+	{false, false, "deep/foo/bar", "**/bar/*"},
+	{true, true, "deep/foo/bar/", "**/bar/**"},
+	{false, false, "foo/bar/baz", "**/bar**"},
+	{true, true, "foo/bar/baz/x", "*/bar/**"},
+	{false, false, "deep/foo/bar/baz/x", "*/bar/**"},
+	{true, true, "deep/foo/bar/baz/x", "**/bar/*/*"},
+
+	// various additional tests
+	{false, false, "acrt", "a[c-c]st"},
+	{true, true, "acrt", "a[c-c]rt"},
+	{false, false, "]", "[!]-]"},
+	{true, true, "a", "[!]-]"},
+	{false, false, "", `\`},
+	{false, false, `\`, `\`},
+	{false, false, "XXX/\\", `*/\`},
+	{true, true, "XXX/\\", `*/\\`},
+	{true, true, "foo", "foo"},
+	{true, true, "@foo", "@foo"},
+	{false, false, "foo", "@foo"},
+	{true, true, "[ab]", `\[ab]`},
+	{true, true, "[ab]", "[[]ab]"},
+	{true, true, "[ab]", "[[:]ab]"},
+	{false, false, "[ab]", "[[::]ab]"},
+	{true, true, "[ab]", "[[:digit]ab]"},
+	{true, true, "[ab]", `[\[:]ab]`},
+	{true, true, "?a?b", `\??\?b`},
+	{true, true, "abc", `\a\b\c`},
+	{false, false, "foo", ""},
+	{true, true, "foo/bar/baz/to", "**/t[o]"},
+
+	// character class tests
+	{true, true, "a1B", "[[:alpha:]][[:digit:]][[:upper:]]"},
+	{false, true, "a", "[[:digit:][:upper:][:space:]]"},
+	{true, true, "A", "[[:digit:][:upper:][:space:]]"},
+	{true, true, "1", "[[:digit:][:upper:][:space:]]"},
+	{false, false, "1", "[[:digit:][:upper:][:spaci:]]"},
+	{true, true, " ", "[[:digit:][:upper:][:space:]]"},
+	{false, false, ".", "[[:digit:][:upper:][:space:]]"},
+	{true, true, ".", "[[:digit:][:punct:][:space:]]"},
+	{true, true, "5", "[[:xdigit:]]"},
+	{true, true, "f", "[[:xdigit:]]"},
+	{true, true, "D", "[[:xdigit:]]"},
+	{true, true, "_", "[[:alnum:][:alpha:][:blank:][:cntrl:][:digit:][:graph:][:lower:][:print:][:punct:][:space:][:upper:][:xdigit:]]"},
+	{true, true, ".", "[^[:alnum:][:alpha:][:blank:][:cntrl:][:digit:][:lower:][:space:][:upper:][:xdigit:]]"},
+	{true, true, "5", "[a-c[:digit:]x-z]"},
+	{true, true, "b", "[a-c[:digit:]x-z]"},
+	{true, true, "y", "[a-c[:digit:]x-z]"},
+	{false, false, "q", "[a-c[:digit:]x-z]"},
+
+	// additional tests, including some malformed wildmatch patterns
+	{true, true, "]", `[\\-^]`},
+	{false, false, "[", `[\\-^]`},
+	{true, true, "-", `[\-_]`},
+	{true, true, "]", `[\]]`},
+	{false, false, `\]`, `[\]]`},
+	{false, false, `\`, `[\]]`},
+	{false, false, "ab", "a[]b"},
+	{false, false, "a[]b", "a[]b"},
+	{false, false, "ab[", "ab["},
+	{false, false, "ab", "[!"},
+	{false, false, "ab", "[-"},
+	{true, true, "-", "[-]"},
+	{false, false, "-", "[a-"},
+	{false, false, "-", "[!a-"},
+	{true, true, "-", "[--A]"},
+	{true, true, "5", "[--A]"},
+	{true, true, " ", "[ --]"},
+	{true, true, "$", "[ --]"},
+	{true, true, "-", "[ --]"},
+	{false, false, "0", "[ --]"},
+	{true, true, "-", "[---]"},
+	{true, true, "-", "[------]"},
+	{false, false, "j", "[a-e-n]"},
+	{true, true, "-", "[a-e-n]"},
+	{true, true, "a", "[!------]"},
+	{false, false, "[", "[]-a]"},
+	{true, true, "^", "[]-a]"},
+	{false, false, "^", "[!]-a]"},
+	{true, true, "[", "[!]-a]"},
+	{true, true, "^", "[a^bc]"},
+	{true, true, "-b]", "[a-]b]"},
+	{false, false, `\`, `[\]`},
+	{true, true, `\`, `[\\]`},
+	{false, false, `\`, `[!\\]`},
+	{true, true, "G", `[A-\\]`},
+	{false, false, "aaabbb", "b*a"},
+	{false, false, "aabcaa", "*ba*"},
+	{true, true, ",", "[,]"},
+	{true, true, ",", `[\\,]`},
+	{true, true, `\`, `[\\,]`},
+	{true, true, "-", "[,-.]"},
+	{false, false, "+", "[,-.]"},
+	{false, false, "-.]", "[,-.]"},
+	{true, true, "2", `[\1-\3]`},
+	{true, true, "3", `[\1-\3]`},
+	{false, false, "4", `[\1-\3]`},
+	{true, true, `\`, `[[-\]]`},
+	{true, true, "[", `[[-\]]`},
+	{true, true, "]", `[[-\]]`},
+	{false, false, "-", `[[-\]]`},
+
+	// recursion and the abort code
+	{true, true, "-adobe-courier-bold-o-normal--12-120-75-75-m-70-iso8859-1", "-*-*-*-*-*-*-12-*-*-*-m-*-*-*"},
+	{false, false, "-adobe-courier-bold-o-normal--12-120-75-75-X-70-iso8859-1", "-*-*-*-*-*-*-12-*-*-*-m-*-*-*"},
+	{false, false, "-adobe-courier-bold-o-normal--12-120-75-75-/-70-iso8859-1", "-*-*-*-*-*-*-12-*-*-*-m-*-*-*"},
+	{true, true, "XXX/adobe/courier/bold/o/normal//12/120/75/75/m/70/iso8859/1", "XXX/*/*/*/*/*/*/12/*/*/*/m/*/*/*"},
+	{false, false, "XXX/adobe/courier/bold/o/normal//12/120/75/75/X/70/iso8859/1", "XXX/*/*/*/*/*/*/12/*/*/*/m/*/*/*"},
+	{true, true, "abcd/abcdefg/abcdefghijk/abcdefghijklmnop.txt", "**/*a*b*g*n*t"},
+	{false, false, "abcd/abcdefg/abcdefghijk/abcdefghijklmnop.txtz", "**/*a*b*g*n*t"},
+	{false, false, "foo", "*/*/*"},
+	{false, false, "foo/bar", "*/*/*"},
+	{true, true, "foo/bba/arr", "*/*/*"},
+	{false, false, "foo/bb/aa/rr", "*/*/*"},
+	{true, true, "foo/bb/aa/rr", "**/**/**"},
+	{true, true, "abcXdefXghi", "*X*i"},
+	{false, false, "ab/cXd/efXg/hi", "*X*i"},
+	{true, true, "ab/cXd/efXg/hi", "*/*X*/*/*i"},
+	{true, true, "ab/cXd/efXg/hi", "**/*X*/**/*i"},
+
+	// case-sensitivity features
+	{false, true, "a", "[A-Z]"},
+	{true, true, "A", "[A-Z]"},
+	{false, true, "A", "[a-z]"},
+	{true, true, "a", "[a-z]"},
+	{false, true, "a", "[[:upper:]]"},
+	{true, true, "A", "[[:upper:]]"},
+	{false, true, "A", "[[:lower:]]"},
+	{true, true, "a", "[[:lower:]]"},
+	{false, true, "A", "[B-Za]"},
+	{true, true, "a", "[B-Za]"},
+	{false, true, "A", "[B-a]"},
+	{true, true, "a", "[B-a]"},
+	{false, true, "z", "[Z-y]"},
+	{true, true, "Z", "[Z-y]"},
+}
+
+func TestWildmatch(t *testing.T) {
+	for _, tt := range wildmatchTests {
+		if got := Wildmatch(tt.pattern, tt.text, false); got != tt.match {
+			t.Errorf("Wildmatch(%q, %q) = %v, want %v",
+				tt.pattern, tt.text, got, tt.match)
+		}
+		if got := Wildmatch(tt.pattern, tt.text, true); got != tt.imatch {
+			t.Errorf("Wildmatch(%q, %q, casefold) = %v, want %v",
+				tt.pattern, tt.text, got, tt.imatch)
+		}
+	}
+}
+
+// checked against `git check-ignore --no-index`
+var gitPatternTests = []struct {
+	pattern, path string
+	isdir, match  bool
+}{
+	{"foo", "foo", false, true},
+	{"foo", "a/foo", false, true},
+	{"/foo", "foo", false, true},
+	{"/foo", "a/foo", false, false},
+	{"a/foo", "a/foo", false, true},
+	{"a/foo", "b/a/foo", false, false},
+	{"foo/", "foo", false, false},
+	{"foo/", "foo", true, true},
+	{"foo/", "a/foo", true, true},
+	{"*.log", "a/b/x.log", false, true},
+	{"a/*.log", "a/x.log", false, true},
+	{"a/*.log", "a/b/x.log", false, false},
+	{"**/foo", "foo", false, true},
+	{"**/foo", "a/b/foo", false, true},
+	{"a/**", "a/b/c", false, true},
+	{"a/**", "a", true, false},
+	{"a/**/b", "a/b", false, true},
+	{"a/**/b", "a/x/y/b", false, true},
+	{"b/**/", "b/c", true, true},
+	{"b/**/", "b/c", false, false},
+	{`\!important`, "!important", false, true},
+	{`trailing\ `, "trailing ", false, true},
+}
+
+func TestGitPattern(t *testing.T) {
+	for _, tt := range gitPatternTests {
+		p := parseGitPattern(tt.pattern)
+		if got := p.Match(tt.path, tt.isdir); got != tt.match {
+			t.Errorf("%q.Match(%q, isdir=%v) = %v, want %v",
+				tt.pattern, tt.path, tt.isdir, got, tt.match)
+		}
+	}
+}
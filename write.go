@@ -0,0 +1,117 @@
+// (c) 2011-2014 Alexander Solovyov
+// under terms of ISC license
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// How replacements are written to symlinks and hard links
+const (
+	// write to the file link points to, keeping the link intact
+	LinksFollow = "follow"
+	// replace the link itself with a regular file
+	LinksReplace = "replace"
+)
+
+// WriteFile replaces content of fn with data, so that fn contains either old
+// or new content even if gr is killed or disk fills up in the middle of the
+// write. New content is written to a temporary file in the same directory,
+// synced and renamed over the original, keeping its mode and (if possible)
+// ownership. Modification time is updated, like with any other write.
+//
+// Hard links can't be written through with a rename, so with LinksFollow
+// files having several links are rewritten in place instead, which is not
+// atomic: if the write fails in the middle, the file is left truncated or
+// half-written (and can be restored with --undo or from a backup). Use
+// LinksReplace to write them atomically, breaking the link.
+func WriteFile(fn string, data []byte, links string) error {
+	fi, err := os.Stat(fn)
+	if err != nil {
+		return err
+	}
+
+	target := fn
+	if links == LinksFollow {
+		target, err = filepath.EvalSymlinks(fn)
+		if err != nil {
+			return err
+		}
+
+		if linkCount(fi) > 1 {
+			return writeInPlace(target, data)
+		}
+	}
+
+	dir, base := filepath.Split(target)
+	if dir == "" {
+		dir = "."
+	}
+
+	tmp, err := ioutil.TempFile(dir, "."+base+".gr")
+	if err != nil {
+		return err
+	}
+
+	err = writeTemp(tmp, fi, data)
+	if err == nil {
+		err = os.Rename(tmp.Name(), target)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	// make rename itself durable, not every platform can sync a directory
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+	return nil
+}
+
+func writeTemp(tmp *os.File, fi os.FileInfo, data []byte) error {
+	_, err := tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := os.Chmod(tmp.Name(), fi.Mode().Perm()); err != nil {
+		return err
+	}
+
+	// only root can give files away, so failure here is not fatal
+	if uid, gid, ok := fileOwner(fi); ok {
+		os.Chown(tmp.Name(), uid, gid)
+	}
+	return nil
+}
+
+// Overwrites content of fn, keeping its inode, so that all hard links to it
+// see new content
+func writeInPlace(fn string, data []byte) error {
+	f, err := os.OpenFile(fn, os.O_WRONLY, 0666)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	n, err := f.Write(data)
+	if err != nil {
+		return err
+	}
+	if err := f.Truncate(int64(n)); err != nil {
+		return fmt.Errorf("can't truncate to size %d: %s", n, err)
+	}
+	return f.Sync()
+}